@@ -11,13 +11,16 @@ import (
 	"github.com/joho/godotenv"
 
 	models "github.com/GineHyte/server/models"
+	alert "github.com/GineHyte/server/utils/alert"
 	auth "github.com/GineHyte/server/utils/auth"
+	dashboard "github.com/GineHyte/server/utils/dashboard"
+	heizung "github.com/GineHyte/server/utils/heizung"
 	klingel "github.com/GineHyte/server/utils/klingel"
 	query "github.com/GineHyte/server/utils/query"
 	register "github.com/GineHyte/server/utils/register"
 	schalter "github.com/GineHyte/server/utils/schalter"
 	scripter "github.com/GineHyte/server/utils/scripter"
-	tools "github.com/GineHyte/server/utils/tools"
+	urlaub "github.com/GineHyte/server/utils/urlaub"
 )
 
 /* main */
@@ -28,22 +31,107 @@ func main() {
 	//clear terminal
 	fmt.Print("\033[H\033[J")
 
+	err := schalter.CreateSchalterGroupTables()
+	if err != nil {
+		log.Printf(models.Red+"error creating schalter group tables: %s\n"+models.Reset, err)
+	}
+
+	err = schalter.CreateSchalterTypeTable()
+	if err != nil {
+		log.Printf(models.Red+"error creating schalter type table: %s\n"+models.Reset, err)
+	}
+	err = schalter.CreateCommandTable()
+	if err != nil {
+		log.Printf(models.Red+"error creating schalter command table: %s\n"+models.Reset, err)
+	}
+	err = schalter.CreateHistoryTable()
+	if err != nil {
+		log.Printf(models.Red+"error creating schalter history table: %s\n"+models.Reset, err)
+	}
+	err = schalter.CreateLeaseTable()
+	if err != nil {
+		log.Printf(models.Red+"error creating lease table: %s\n"+models.Reset, err)
+	}
+	err = schalter.LoadLeases()
+	if err != nil {
+		log.Printf(models.Red+"error loading leases: %s\n"+models.Reset, err)
+	}
+
+	err = schalter.CreateMqttTable()
+	if err != nil {
+		log.Printf(models.Red+"error creating mqtt table: %s\n"+models.Reset, err)
+	}
+	err = schalter.StartMqtt()
+	if err != nil {
+		log.Printf(models.Red+"error starting mqtt: %s\n"+models.Reset, err)
+	}
+
+	err = schalter.CreateProtectionTable()
+	if err != nil {
+		log.Printf(models.Red+"error creating protection table: %s\n"+models.Reset, err)
+	}
+	err = urlaub.CreateUrlaubTable()
+	if err != nil {
+		log.Printf(models.Red+"error creating urlaub table: %s\n"+models.Reset, err)
+	}
+	err = urlaub.LoadUrlaub()
+	if err != nil {
+		log.Printf(models.Red+"error loading urlaub: %s\n"+models.Reset, err)
+	}
+	err = alert.CreateAlertTables()
+	if err != nil {
+		log.Printf(models.Red+"error creating alert tables: %s\n"+models.Reset, err)
+	}
+	err = dashboard.CreateDashboardTables()
+	if err != nil {
+		log.Printf(models.Red+"error creating dashboard tables: %s\n"+models.Reset, err)
+	}
+	err = heizung.CreateHeizungTables()
+	if err != nil {
+		log.Printf(models.Red+"error creating heizung tables: %s\n"+models.Reset, err)
+	}
+
 	go schalter.SchalterEventStream()
-	go tools.SchalterDbTimer()
+	go schalter.SchalterDiscoveryJob()
+	go schalter.ProtectionJob()
+	go urlaub.UrlaubJob()
+	go heizung.HeizungJob()
+	go alert.AlertJob()
 
 	http.HandleFunc("/register", register.Register)
 	http.HandleFunc("/auth", auth.Auth)
 	http.HandleFunc("/query", query.Query)
+	http.HandleFunc("/query/cache", query.QueryCache)
+	http.HandleFunc("/query/export", query.Export)
+	http.HandleFunc("/query/live", query.Live)
+	http.HandleFunc("/query/series", query.Series)
+	http.HandleFunc("/queries", dashboard.SavedQueries)
+	http.HandleFunc("/queries/run", dashboard.RunQuery)
+	http.HandleFunc("/dashboards", dashboard.Dashboards)
+	http.HandleFunc("/alerts", alert.Alerts)
 	http.HandleFunc("/schalter", schalter.SchalterControl)
+	http.HandleFunc("/schalter/commands", schalter.SchalterCommands)
+	http.HandleFunc("/schalter/discovery", schalter.SchalterDiscovery)
+	http.HandleFunc("/schalter/events", schalter.SchalterEvents)
+	http.HandleFunc("/schalter/groups", schalter.SchalterGroups)
+	http.HandleFunc("/schalter/health", schalter.SchalterHealth)
+	http.HandleFunc("/schalter/history", schalter.SchalterHistory)
+	http.HandleFunc("/schalter/mqtt", schalter.SchalterMqtt)
+	http.HandleFunc("/schalter/protection", schalter.SchalterProtection)
+	http.HandleFunc("/schalter/rooms", schalter.SchalterRooms)
+	http.HandleFunc("/schalter/sitemaps", schalter.SchalterSitemaps)
+	http.HandleFunc("/schalter/types", schalter.SchalterTypes)
 	http.HandleFunc("/script", scripter.Script)
 	http.HandleFunc("/control_script", scripter.ControlScript)
+	http.HandleFunc("/urlaub", urlaub.Urlaub)
+	http.HandleFunc("/heizung", heizung.Heizung)
 
 	http.HandleFunc("/mail", klingel.Mail)
 	http.HandleFunc("/klingel", klingel.Klingel)
 
 	http.HandleFunc("/klingel_events", klingel.Events)
 
-	err := http.ListenAndServe(":3333", nil)
+	err = http.ListenAndServe(":3333", nil)
 
 	if errors.Is(err, http.ErrServerClosed) {
 		log.Printf(models.Green + "server closed\n" + models.Reset)
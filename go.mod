@@ -3,14 +3,20 @@ module github.com/GineHyte/server
 go 1.21.0
 
 require (
-	github.com/asynkron/protoactor-go v0.0.0-20231013060723-291b4cf177db
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/go-sql-driver/mysql v1.7.1
 	github.com/joho/godotenv v1.5.1
 	github.com/mailjet/mailjet-apiv3-go v0.0.0-20201009050126-c24bc15a9394
+	github.com/mochi-mqtt/server/v2 v2.6.6
 	github.com/r3labs/sse/v2 v2.10.0
+	gopkg.in/cenkalti/backoff.v1 v1.1.0
 )
 
 require (
-	golang.org/x/net v0.15.0 // indirect
-	gopkg.in/cenkalti/backoff.v1 v1.1.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	github.com/stretchr/testify v1.8.4 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/sync v0.2.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
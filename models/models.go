@@ -1,5 +1,10 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
 var Reset = "\033[0m"
 var Red = "\033[31m"
 var Green = "\033[32m"
@@ -16,12 +21,284 @@ type Pair struct {
 }
 
 type SchalterStatus struct {
-	Name           string  `json:"name"`
-	State          string  `json:"state"`
-	WidgetId       string  `json:"widgetId"`
-	Locked         int     `json:"locked"`
-	ScriptState    bool    `json:"scriptState"`
-	CurrentCommand *string `json:"currentCommand"`
+	Name           string          `json:"name"`
+	State          string          `json:"state"`
+	WidgetId       string          `json:"widgetId"`
+	Locked         int             `json:"locked"`
+	LockOwner      *SchalterSource `json:"lockOwner"`
+	LockedUntil    *time.Time      `json:"lockedUntil"`
+	ControlledBy   *SchalterSource `json:"controlledBy"`
+	Priority       int             `json:"priority"`
+	ScriptState    bool            `json:"scriptState"`
+	CurrentCommand *string         `json:"currentCommand"`
+	Room           string          `json:"room"`
+	Floor          string          `json:"floor"`
+	Type           string          `json:"type"`
+	Value          *SchalterValue  `json:"value,omitempty"`
+}
+
+var TypeSwitch = "switch"
+var TypeShutter = "shutter"
+var TypeDimmer = "dimmer"
+var TypeColorTemp = "colortemp"
+var TypeColor = "color"
+var TypeSetpoint = "setpoint"
+
+type SchalterValue struct {
+	Percent    *float64 `json:"percent,omitempty"`
+	Kelvin     *float64 `json:"kelvin,omitempty"`
+	Hue        *float64 `json:"hue,omitempty"`
+	Saturation *float64 `json:"saturation,omitempty"`
+	Brightness *float64 `json:"brightness,omitempty"`
+	Number     *float64 `json:"number,omitempty"`
+}
+
+var SourceUser = "user"
+var SourceScript = "script"
+var SourceHardware = "hardware"
+var SourceSchedule = "schedule"
+var SourceSafety = "safety"
+
+type SchalterSource struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type SchalterHistoryEntry struct {
+	Name     string         `json:"name"`
+	OldState string         `json:"oldState"`
+	NewState string         `json:"newState"`
+	Source   SchalterSource `json:"source"`
+	Time     time.Time      `json:"time"`
+}
+
+type SchalterLease struct {
+	Name    string         `json:"name"`
+	Owner   SchalterSource `json:"owner"`
+	Expires time.Time      `json:"expires"`
+}
+
+type SchalterGroup struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type SchalterCommandResult struct {
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+var CommandPending = "pending"
+var CommandSent = "sent"
+var CommandAcked = "acked"
+var CommandUnconfirmed = "unconfirmed"
+var CommandFailed = "failed"
+
+type SchalterCommandEntry struct {
+	Id       int64     `json:"id"`
+	Item     string    `json:"item"`
+	State    string    `json:"state"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+type SchalterEvent struct {
+	Id        int             `json:"id"`
+	Type      string          `json:"type"`
+	Time      time.Time       `json:"time"`
+	Status    *SchalterStatus `json:"status,omitempty"`
+	Preempted *SchalterSource `json:"preempted,omitempty"`
+}
+
+type SchalterPage struct {
+	Sitemap string `json:"sitemap"`
+	Page    string `json:"page"`
+}
+
+type SitemapWidget struct {
+	Sitemap  string `json:"sitemap"`
+	Page     string `json:"page"`
+	WidgetId string `json:"widgetId"`
+	Type     string `json:"type"`
+	Label    string `json:"label"`
+	Item     string `json:"item"`
+	ItemType string `json:"itemType"`
+	State    string `json:"state"`
+}
+
+type SchalterStreamHealth struct {
+	Sitemap    string     `json:"sitemap"`
+	Page       string     `json:"page"`
+	Connected  bool       `json:"connected"`
+	Since      *time.Time `json:"since"`
+	LastEvent  *time.Time `json:"lastEvent"`
+	LastError  string     `json:"lastError"`
+	Reconnects int        `json:"reconnects"`
+}
+
+var DiscoveryAdd = "add"
+var DiscoveryRemove = "remove"
+var DiscoveryRename = "rename"
+
+type SchalterDiscoveryChange struct {
+	Id       string `json:"id"`
+	Action   string `json:"action"`
+	Name     string `json:"name"`
+	OldName  string `json:"oldName,omitempty"`
+	WidgetId string `json:"widgetId"`
+	Type     string `json:"type"`
+	Label    string `json:"label"`
+	State    string `json:"state"`
+	Sitemap  string `json:"sitemap"`
+	Page     string `json:"page"`
+}
+
+type MqttDevice struct {
+	Name         string `json:"name"`
+	Device       string `json:"device"`
+	CommandTopic string `json:"commandTopic"`
+	StateTopic   string `json:"stateTopic"`
+	PayloadOn    string `json:"payloadOn"`
+	PayloadOff   string `json:"payloadOff"`
+}
+
+type UrlaubAction struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	Time     time.Time `json:"time"`
+	ReplayOf time.Time `json:"replayOf"`
+	Done     bool      `json:"done"`
+}
+
+type UrlaubStatus struct {
+	Armed   bool           `json:"armed"`
+	Since   *time.Time     `json:"since"`
+	Until   *time.Time     `json:"until"`
+	Weeks   int            `json:"weeks"`
+	Jitter  int            `json:"jitter"`
+	Reason  string         `json:"reason"`
+	Planned []UrlaubAction `json:"planned"`
+}
+
+var ProtectionWind = "wind"
+var ProtectionRain = "rain"
+var ProtectionFrost = "frost"
+
+type ProtectionRule struct {
+	Name      string  `json:"name"`
+	Kind      string  `json:"kind"`
+	Query     string  `json:"query"`
+	Threshold float64 `json:"threshold"`
+	Target    string  `json:"target"`
+	State     string  `json:"state"`
+	Hold      int     `json:"hold"`
+}
+
+type ProtectionStatus struct {
+	Rule      ProtectionRule `json:"rule"`
+	Active    bool           `json:"active"`
+	Value     *float64       `json:"value"`
+	Checked   *time.Time     `json:"checked"`
+	Since     *time.Time     `json:"since"`
+	Clear     *time.Time     `json:"clear"`
+	Shutters  []string       `json:"shutters"`
+	LastError string         `json:"lastError"`
+}
+
+var AlertValue = "value"
+var AlertRate = "rate"
+var AlertAbsence = "absence"
+
+var AlertOk = "ok"
+var AlertPending = "pending"
+var AlertFiring = "firing"
+var AlertResolved = "resolved"
+
+type AlertRule struct {
+	Name      string  `json:"name"`
+	Series    string  `json:"series"`
+	Kind      string  `json:"kind"`
+	Operator  string  `json:"operator"`
+	Threshold float64 `json:"threshold"`
+	Window    string  `json:"window"`
+	For       int     `json:"for"`
+	Repeat    int     `json:"repeat"`
+	Mail      string  `json:"mail"`
+	Webhook   string  `json:"webhook"`
+	Enabled   bool    `json:"enabled"`
+}
+
+type AlertSilence struct {
+	Id        int       `json:"id"`
+	Rule      string    `json:"rule"`
+	Until     time.Time `json:"until"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"createdBy"`
+}
+
+type AlertStatus struct {
+	Rule      AlertRule  `json:"rule"`
+	State     string     `json:"state"`
+	Value     *float64   `json:"value"`
+	Since     *time.Time `json:"since"`
+	Checked   *time.Time `json:"checked"`
+	Notified  *time.Time `json:"notified"`
+	Silenced  bool       `json:"silenced"`
+	LastError string     `json:"lastError"`
+}
+
+type AlertEvent struct {
+	Rule    string    `json:"rule"`
+	Series  string    `json:"series"`
+	State   string    `json:"state"`
+	Value   *float64  `json:"value"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type AlertsResponse struct {
+	Alerts   []AlertStatus  `json:"alerts"`
+	Silences []AlertSilence `json:"silences"`
+}
+
+var HeizungHysteresis = "hysteresis"
+var HeizungPID = "pid"
+
+type HeizungRoom struct {
+	Room       string   `json:"room"`
+	Sensor     string   `json:"sensor"`
+	Valves     []string `json:"valves"`
+	Window     string   `json:"window"`
+	Target     float64  `json:"target"`
+	Hysteresis float64  `json:"hysteresis"`
+	Mode       string   `json:"mode"`
+	Kp         float64  `json:"kp"`
+	Ki         float64  `json:"ki"`
+	Kd         float64  `json:"kd"`
+	Enabled    bool     `json:"enabled"`
+}
+
+type HeizungSchedule struct {
+	Room    string  `json:"room"`
+	Weekday int     `json:"weekday"`
+	Start   string  `json:"start"`
+	Target  float64 `json:"target"`
+}
+
+type HeizungStatus struct {
+	Room       HeizungRoom       `json:"room"`
+	Schedule   []HeizungSchedule `json:"schedule"`
+	Current    *float64          `json:"current"`
+	Target     float64           `json:"target"`
+	WindowOpen bool              `json:"windowOpen"`
+	Heating    bool              `json:"heating"`
+	Output     float64           `json:"output"`
+	Checked    *time.Time        `json:"checked"`
+	LastError  string            `json:"lastError"`
 }
 
 type QueryResponse struct {
@@ -30,6 +307,75 @@ type QueryResponse struct {
 	Amount   int      `json:"amount"`
 }
 
+type QueryRow struct {
+	Time   *time.Time             `json:"time"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+type QueryTable struct {
+	Name   string            `json:"name"`
+	Result string            `json:"result"`
+	Tags   map[string]string `json:"tags"`
+	Fields []string          `json:"fields"`
+	Rows   []QueryRow        `json:"rows"`
+}
+
+type QueryTablesResponse struct {
+	Version int          `json:"version"`
+	Tables  []QueryTable `json:"tables"`
+	Amount  int          `json:"amount"`
+}
+
+type QueryCacheStats struct {
+	Entries    int     `json:"entries"`
+	MaxEntries int     `json:"maxEntries"`
+	TTL        int     `json:"ttl"`
+	Hits       int64   `json:"hits"`
+	Misses     int64   `json:"misses"`
+	Evictions  int64   `json:"evictions"`
+	HitRate    float64 `json:"hitRate"`
+}
+
+type QueryLivePoint struct {
+	Name  string      `json:"name"`
+	Field string      `json:"field"`
+	Time  time.Time   `json:"time"`
+	Value interface{} `json:"value"`
+}
+
+var SeriesMean = "mean"
+var SeriesMin = "min"
+var SeriesMax = "max"
+var SeriesLast = "last"
+
+type SeriesQuery struct {
+	Series []string `json:"series"`
+	Start  string   `json:"start"`
+	Stop   string   `json:"stop"`
+	Window string   `json:"window"`
+	Fn     string   `json:"fn"`
+	Points int      `json:"points"`
+}
+
+type SavedQuery struct {
+	Id         int          `json:"id"`
+	Owner      string       `json:"owner"`
+	Name       string       `json:"name"`
+	Series     *SeriesQuery `json:"series"`
+	Flux       string       `json:"flux,omitempty"`
+	SharedWith []string     `json:"sharedWith"`
+	Updated    time.Time    `json:"updated"`
+}
+
+type Dashboard struct {
+	Id         int             `json:"id"`
+	Owner      string          `json:"owner"`
+	Name       string          `json:"name"`
+	Layout     json.RawMessage `json:"layout"`
+	SharedWith []string        `json:"sharedWith"`
+	Updated    time.Time       `json:"updated"`
+}
+
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
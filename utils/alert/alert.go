@@ -0,0 +1,569 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	models "github.com/GineHyte/server/models"
+	klingel "github.com/GineHyte/server/utils/klingel"
+	query "github.com/GineHyte/server/utils/query"
+	tools "github.com/GineHyte/server/utils/tools"
+)
+
+var ErrAlertValue = errors.New("invalid alert value")
+
+// states live in memory, a restart starts every rule at ok again
+var alertStates = make(map[string]*models.AlertStatus)
+var alertMu sync.Mutex
+
+func CreateAlertTables() error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("createAlertTables: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.AlertRules (name VARCHAR(255) NOT NULL PRIMARY KEY, series VARCHAR(255) NOT NULL, kind VARCHAR(32) NOT NULL, operator VARCHAR(2) NOT NULL, threshold DOUBLE NOT NULL, evalWindow VARCHAR(32) NOT NULL, forSeconds INT NOT NULL, repeatSeconds INT NOT NULL, mail VARCHAR(255) NOT NULL, webhook VARCHAR(1024) NOT NULL, enabled BOOL NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("createAlertTables: %s", err)
+	}
+
+	//an empty rule silences every rule
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.AlertSilences (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, rule VARCHAR(255) NOT NULL, until BIGINT NOT NULL, reason VARCHAR(1024) NOT NULL, createdBy VARCHAR(255) NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("createAlertTables: %s", err)
+	}
+
+	return nil
+}
+
+func GetAlertRules() ([]models.AlertRule, error) {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return []models.AlertRule{}, fmt.Errorf("getAlertRules: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name, series, kind, operator, threshold, evalWindow, forSeconds, repeatSeconds, mail, webhook, enabled FROM sys.AlertRules ORDER BY name")
+	if err != nil {
+		return []models.AlertRule{}, fmt.Errorf("getAlertRules: %s", err)
+	}
+	defer rows.Close()
+
+	rules := make([]models.AlertRule, 0)
+	for rows.Next() {
+		var rule models.AlertRule
+		err := rows.Scan(&rule.Name, &rule.Series, &rule.Kind, &rule.Operator, &rule.Threshold, &rule.Window, &rule.For, &rule.Repeat, &rule.Mail, &rule.Webhook, &rule.Enabled)
+		if err != nil {
+			return []models.AlertRule{}, fmt.Errorf("getAlertRules: %s", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func SetAlertRule(rule models.AlertRule) error {
+	if rule.Name == "" || rule.Series == "" {
+		return fmt.Errorf("%w: a rule needs a name and a series", ErrAlertValue)
+	}
+	if rule.Kind != models.AlertValue && rule.Kind != models.AlertRate && rule.Kind != models.AlertAbsence {
+		return fmt.Errorf("%w: unknown kind %s", ErrAlertValue, rule.Kind)
+	}
+	if rule.Kind != models.AlertAbsence && rule.Operator != ">" && rule.Operator != "<" {
+		return fmt.Errorf("%w: operator has to be > or <", ErrAlertValue)
+	}
+	if rule.Window == "" {
+		rule.Window = "10m"
+	}
+	if _, err := query.BuildSeriesQuery(models.SeriesQuery{Series: []string{rule.Series}, Start: "-" + rule.Window}); err != nil {
+		return fmt.Errorf("%w: %s", ErrAlertValue, err)
+	}
+	if rule.For < 0 || rule.Repeat < 0 {
+		return fmt.Errorf("%w: for and repeat can not be negative", ErrAlertValue)
+	}
+
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("setAlertRule: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO sys.AlertRules (name, series, kind, operator, threshold, evalWindow, forSeconds, repeatSeconds, mail, webhook, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE series = VALUES(series), kind = VALUES(kind), operator = VALUES(operator), threshold = VALUES(threshold), evalWindow = VALUES(evalWindow), forSeconds = VALUES(forSeconds), repeatSeconds = VALUES(repeatSeconds), mail = VALUES(mail), webhook = VALUES(webhook), enabled = VALUES(enabled)",
+		rule.Name, rule.Series, rule.Kind, rule.Operator, rule.Threshold, rule.Window, rule.For, rule.Repeat, rule.Mail, rule.Webhook, rule.Enabled)
+	if err != nil {
+		return fmt.Errorf("setAlertRule: %s", err)
+	}
+
+	return nil
+}
+
+func DeleteAlertRule(name string) error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("deleteAlertRule: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM sys.AlertRules WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("deleteAlertRule: %s", err)
+	}
+
+	alertMu.Lock()
+	delete(alertStates, name)
+	alertMu.Unlock()
+
+	return nil
+}
+
+func GetAlertSilences() ([]models.AlertSilence, error) {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return []models.AlertSilence{}, fmt.Errorf("getAlertSilences: %s", err)
+	}
+	defer db.Close()
+
+	//expired silences are dropped on the way
+	_, err = db.Exec("DELETE FROM sys.AlertSilences WHERE until <= ?", time.Now().UnixMilli())
+	if err != nil {
+		return []models.AlertSilence{}, fmt.Errorf("getAlertSilences: %s", err)
+	}
+
+	rows, err := db.Query("SELECT id, rule, until, reason, createdBy FROM sys.AlertSilences ORDER BY until")
+	if err != nil {
+		return []models.AlertSilence{}, fmt.Errorf("getAlertSilences: %s", err)
+	}
+	defer rows.Close()
+
+	silences := make([]models.AlertSilence, 0)
+	for rows.Next() {
+		var silence models.AlertSilence
+		var until int64
+		err := rows.Scan(&silence.Id, &silence.Rule, &until, &silence.Reason, &silence.CreatedBy)
+		if err != nil {
+			return []models.AlertSilence{}, fmt.Errorf("getAlertSilences: %s", err)
+		}
+		silence.Until = time.UnixMilli(until)
+		silences = append(silences, silence)
+	}
+
+	return silences, nil
+}
+
+func AddAlertSilence(silence models.AlertSilence) (int, error) {
+	if !silence.Until.After(time.Now()) {
+		return 0, fmt.Errorf("%w: a silence has to end in the future", ErrAlertValue)
+	}
+
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return 0, fmt.Errorf("addAlertSilence: %s", err)
+	}
+	defer db.Close()
+
+	result, err := db.Exec("INSERT INTO sys.AlertSilences (rule, until, reason, createdBy) VALUES (?, ?, ?, ?)", silence.Rule, silence.Until.UnixMilli(), silence.Reason, silence.CreatedBy)
+	if err != nil {
+		return 0, fmt.Errorf("addAlertSilence: %s", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("addAlertSilence: %s", err)
+	}
+	return int(id), nil
+}
+
+func DeleteAlertSilence(id int) error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("deleteAlertSilence: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM sys.AlertSilences WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("deleteAlertSilence: %s", err)
+	}
+	return nil
+}
+
+func silenced(rule string, silences []models.AlertSilence) bool {
+	for _, silence := range silences {
+		if (silence.Rule == "" || silence.Rule == rule) && time.Now().Before(silence.Until) {
+			return true
+		}
+	}
+	return false
+}
+
+func alertInterval() time.Duration {
+	interval, err := strconv.Atoi(os.Getenv("ALERT_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(interval) * time.Second
+}
+
+func AlertJob() {
+	//evaluate every enabled rule
+	for {
+		rules, err := GetAlertRules()
+		if err != nil {
+			log.Printf(models.Red+"error getting alert rules: %s\n"+models.Reset, err)
+		}
+		silences, err := GetAlertSilences()
+		if err != nil {
+			log.Printf(models.Red+"error getting alert silences: %s\n"+models.Reset, err)
+		}
+		for _, rule := range rules {
+			if rule.Enabled {
+				evaluateAlert(rule, silenced(rule.Name, silences), time.Now())
+			}
+		}
+		time.Sleep(alertInterval())
+	}
+}
+
+func alertCondition(rule models.AlertRule) (bool, *float64, error) {
+	//true if the rule is violated, with the value that was compared
+	seriesQuery := models.SeriesQuery{Series: []string{rule.Series}, Start: "-" + rule.Window}
+	queryStr, err := query.BuildSeriesQuery(seriesQuery)
+	if err != nil {
+		return false, nil, err
+	}
+	resp, err := query.QueryInfluxDBWithToken(os.Getenv("ADMIN_TOKEN"), queryStr)
+	if err != nil {
+		return false, nil, err
+	}
+
+	//a series with several fields has one line set per field, the one with
+	//the newest point decides
+	var points []models.Pair
+	var newest time.Time
+	for _, lineSet := range resp.LineSets {
+		if len(lineSet) == 0 {
+			continue
+		}
+		last, err := time.Parse(time.RFC3339Nano, lineSet[len(lineSet)-1].Title)
+		if err != nil {
+			continue
+		}
+		if points == nil || last.After(newest) {
+			points = lineSet
+			newest = last
+		}
+	}
+	if rule.Kind == models.AlertAbsence {
+		return len(points) == 0, nil, nil
+	}
+	if len(points) == 0 {
+		return false, nil, fmt.Errorf("no data for %s in the last %s", rule.Series, rule.Window)
+	}
+
+	last := points[len(points)-1]
+	value := last.Value
+	if rule.Kind == models.AlertRate {
+		//change per minute between the first and the last point of the window
+		//of the same line set
+		first := points[0]
+		start, errStart := time.Parse(time.RFC3339Nano, first.Title)
+		stop, errStop := time.Parse(time.RFC3339Nano, last.Title)
+		if errStart != nil || errStop != nil || !stop.After(start) {
+			return false, nil, fmt.Errorf("not enough points for a rate of %s", rule.Series)
+		}
+		value = (last.Value - first.Value) / stop.Sub(start).Minutes()
+	}
+
+	if rule.Operator == ">" {
+		return value > rule.Threshold, &value, nil
+	}
+	return value < rule.Threshold, &value, nil
+}
+
+func evaluateAlert(rule models.AlertRule, isSilenced bool, now time.Time) {
+	violated, value, err := alertCondition(rule)
+
+	alertMu.Lock()
+	state, ok := alertStates[rule.Name]
+	if !ok {
+		state = &models.AlertStatus{State: models.AlertOk}
+		alertStates[rule.Name] = state
+	}
+	state.Rule = rule
+	state.Checked = &now
+	state.Silenced = isSilenced
+	if err != nil {
+		//a failed query keeps the state, absence rules see no error for no data
+		state.LastError = err.Error()
+		alertMu.Unlock()
+		log.Printf(models.Red+"alert %s: %s\n"+models.Reset, rule.Name, err)
+		return
+	}
+	state.LastError = ""
+	state.Value = value
+
+	notify := false
+	switch {
+	case violated && (state.State == models.AlertOk || state.State == models.AlertResolved):
+		state.State = models.AlertPending
+		state.Since = &now
+		state.Notified = nil
+		if rule.For == 0 {
+			state.State = models.AlertFiring
+			notify = true
+		}
+	case violated && state.State == models.AlertPending:
+		if now.Sub(*state.Since) >= time.Duration(rule.For)*time.Second {
+			state.State = models.AlertFiring
+			notify = true
+		}
+	case violated && state.State == models.AlertFiring:
+		//an alert that started firing while silenced is sent once the silence
+		//ended, after that only repeated after the repeat interval
+		notify = state.Notified == nil || rule.Repeat > 0 && now.Sub(*state.Notified) >= time.Duration(rule.Repeat)*time.Second
+	case !violated && state.State == models.AlertFiring:
+		//only alerts whose firing was sent are reported as resolved
+		state.State = models.AlertResolved
+		state.Since = &now
+		notify = state.Notified != nil
+	case !violated && state.State != models.AlertOk:
+		state.State = models.AlertOk
+		state.Since = &now
+	}
+
+	//silenced alerts change state but send nothing
+	if notify && !isSilenced {
+		state.Notified = &now
+	}
+	event := models.AlertEvent{Rule: rule.Name, Series: rule.Series, State: state.State, Value: value, Time: now, Message: alertMessage(rule, state.State, value)}
+	alertMu.Unlock()
+
+	if notify && !isSilenced {
+		go notifyAlert(rule, event)
+	}
+}
+
+func alertMessage(rule models.AlertRule, state string, value *float64) string {
+	switch {
+	case rule.Kind == models.AlertAbsence:
+		return fmt.Sprintf("alert %s %s: no data for %s in the last %s", rule.Name, state, rule.Series, rule.Window)
+	case value == nil:
+		return fmt.Sprintf("alert %s %s", rule.Name, state)
+	case rule.Kind == models.AlertRate:
+		return fmt.Sprintf("alert %s %s: %s changes by %.2f per minute (%s %.2f)", rule.Name, state, rule.Series, *value, rule.Operator, rule.Threshold)
+	}
+	return fmt.Sprintf("alert %s %s: %s is %.2f (%s %.2f)", rule.Name, state, rule.Series, *value, rule.Operator, rule.Threshold)
+}
+
+func notifyAlert(rule models.AlertRule, event models.AlertEvent) {
+	//log, mail and webhook for every firing and resolved alert
+	log.Printf(models.Yellow+"%s\n"+models.Reset, event.Message)
+
+	if rule.Mail != "" {
+		err := klingel.SendMail(os.Getenv("MAIL_FROM"), rule.Mail, "Alert "+rule.Name+" "+event.State, event.Message, "")
+		if err != nil {
+			log.Printf(models.Red+"error sending alert mail: %s\n"+models.Reset, err)
+		}
+	}
+
+	if rule.Webhook != "" {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf(models.Red+"error encoding alert webhook: %s\n"+models.Reset, err)
+			return
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(rule.Webhook, "application/json", bytes.NewBuffer(payload))
+		if err != nil {
+			log.Printf(models.Red+"error calling alert webhook: %s\n"+models.Reset, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			log.Printf(models.Red+"alert webhook answered %s\n"+models.Reset, resp.Status)
+		}
+	}
+}
+
+func GetAlertStatuses() ([]models.AlertStatus, error) {
+	rules, err := GetAlertRules()
+	if err != nil {
+		return []models.AlertStatus{}, err
+	}
+
+	alertMu.Lock()
+	defer alertMu.Unlock()
+
+	statuses := make([]models.AlertStatus, 0, len(rules))
+	for _, rule := range rules {
+		status := models.AlertStatus{State: models.AlertOk}
+		if state, ok := alertStates[rule.Name]; ok {
+			status = *state
+		}
+		status.Rule = rule
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func Alerts(w http.ResponseWriter, r *http.Request) {
+	//alert states and silences, admins change rules and silences
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		//check if session token is valid
+		session_token := r.URL.Query().Get("session_token")
+		if session_token == "" {
+			tools.SendError(w, http.StatusUnauthorized, errors.New("no session token"))
+			return
+		}
+		is_valid, err := tools.CheckSession(session_token)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			tools.SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+		is_admin, err := tools.IsAdmin(session_token)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking admin: %s", err))
+			return
+		}
+
+		statuses, err := GetAlertStatuses()
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting alerts: %s", err))
+			return
+		}
+		silences, err := GetAlertSilences()
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting silences: %s", err))
+			return
+		}
+
+		//mail addresses, webhook urls and who silenced what are for admins only
+		if !is_admin {
+			for i := range statuses {
+				statuses[i].Rule.Mail = ""
+				statuses[i].Rule.Webhook = ""
+			}
+			for i := range silences {
+				silences[i].CreatedBy = ""
+			}
+		}
+		json.NewEncoder(w).Encode(models.AlertsResponse{Alerts: statuses, Silences: silences})
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			tools.SendError(w, http.StatusBadRequest, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := tools.CheckSession(session_token)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			tools.SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//only admins change alerts
+		is_admin, err := tools.IsAdmin(session_token)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking admin: %s", err))
+			return
+		}
+		if !is_admin {
+			tools.SendError(w, http.StatusForbidden, errors.New("only admins can change alerts"))
+			return
+		}
+
+		//a silence is added or removed, or a rule is deleted or set
+		result := map[string]interface{}{"success": true}
+		if rawSilence, ok := t["silence"].(map[string]interface{}); ok {
+			silence := models.AlertSilence{}
+			silence.Rule, _ = rawSilence["rule"].(string)
+			silence.Reason, _ = rawSilence["reason"].(string)
+			silence.CreatedBy, _ = tools.GetUsernameFromSession(session_token)
+			if until, ok := rawSilence["until"].(string); ok {
+				silence.Until, err = time.Parse(time.RFC3339, until)
+				if err != nil {
+					tools.SendError(w, http.StatusBadRequest, fmt.Errorf("%w: until is no RFC3339 time", ErrAlertValue))
+					return
+				}
+			} else if minutes, ok := rawSilence["minutes"].(float64); ok {
+				silence.Until = time.Now().Add(time.Duration(minutes) * time.Minute)
+			}
+			var id int
+			id, err = AddAlertSilence(silence)
+			result["id"] = id
+		} else if id, ok := t["deleteSilence"].(float64); ok {
+			err = DeleteAlertSilence(int(id))
+		} else {
+			rule := models.AlertRule{Enabled: true}
+			rule.Name, _ = t["name"].(string)
+			if remove, _ := t["delete"].(bool); remove {
+				err = DeleteAlertRule(rule.Name)
+			} else {
+				rule.Series, _ = t["series"].(string)
+				rule.Kind, _ = t["kind"].(string)
+				rule.Operator, _ = t["operator"].(string)
+				rule.Threshold, _ = t["threshold"].(float64)
+				rule.Window, _ = t["window"].(string)
+				forSeconds, _ := t["for"].(float64)
+				rule.For = int(forSeconds)
+				repeatSeconds, _ := t["repeat"].(float64)
+				rule.Repeat = int(repeatSeconds)
+				rule.Mail, _ = t["mail"].(string)
+				rule.Webhook, _ = t["webhook"].(string)
+				if enabled, ok := t["enabled"].(bool); ok {
+					rule.Enabled = enabled
+				}
+				err = SetAlertRule(rule)
+			}
+		}
+		if errors.Is(err, ErrAlertValue) {
+			tools.SendError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error setting alert: %s", err))
+			return
+		}
+
+		json.NewEncoder(w).Encode(result)
+	default:
+		log.Printf(models.Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + models.Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(models.ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}
@@ -0,0 +1,634 @@
+package dashboard
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	models "github.com/GineHyte/server/models"
+	query "github.com/GineHyte/server/utils/query"
+	tools "github.com/GineHyte/server/utils/tools"
+)
+
+var ErrDashboardNotFound = errors.New("not found")
+var ErrDashboardOwner = errors.New("only the owner can change this")
+var ErrDashboardValue = errors.New("invalid value")
+
+// shares point at a saved query or a dashboard by kind and id
+var shareQuery = "query"
+var shareDashboard = "dashboard"
+
+func CreateDashboardTables() error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("createDashboardTables: %s", err)
+	}
+	defer db.Close()
+
+	//owners are usernames of sys.accounts
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.SavedQueries (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, owner VARCHAR(255) NOT NULL, name VARCHAR(255) NOT NULL, series TEXT, flux TEXT, updated BIGINT NOT NULL, INDEX (owner))")
+	if err != nil {
+		return fmt.Errorf("createDashboardTables: %s", err)
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.Dashboards (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, owner VARCHAR(255) NOT NULL, name VARCHAR(255) NOT NULL, layout MEDIUMTEXT NOT NULL, updated BIGINT NOT NULL, INDEX (owner))")
+	if err != nil {
+		return fmt.Errorf("createDashboardTables: %s", err)
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.DashboardShares (kind VARCHAR(32) NOT NULL, itemId INT NOT NULL, username VARCHAR(255) NOT NULL, PRIMARY KEY (kind, itemId, username), INDEX (username))")
+	if err != nil {
+		return fmt.Errorf("createDashboardTables: %s", err)
+	}
+
+	return nil
+}
+
+func getShares(db *sql.DB, kind string, id int) ([]string, error) {
+	rows, err := db.Query("SELECT username FROM sys.DashboardShares WHERE kind = ? AND itemId = ? ORDER BY username", kind, id)
+	if err != nil {
+		return []string{}, err
+	}
+	defer rows.Close()
+
+	usernames := make([]string, 0)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return []string{}, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, nil
+}
+
+func setShares(tx *sql.Tx, kind string, id int, usernames []string) error {
+	//replace the accounts an item is shared with, every one has to exist
+	_, err := tx.Exec("DELETE FROM sys.DashboardShares WHERE kind = ? AND itemId = ?", kind, id)
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		var exists int
+		err := tx.QueryRow("SELECT COUNT(*) FROM sys.accounts WHERE username = ?", username).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return fmt.Errorf("%w: unknown account %s", ErrDashboardValue, username)
+		}
+		_, err = tx.Exec("INSERT IGNORE INTO sys.DashboardShares (kind, itemId, username) VALUES (?, ?, ?)", kind, id, username)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkOwner(tx *sql.Tx, table string, id int, username string) error {
+	//the item has to exist and belong to username
+	var owner string
+	err := tx.QueryRow("SELECT owner FROM sys."+table+" WHERE id = ?", id).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return ErrDashboardNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if owner != username {
+		return ErrDashboardOwner
+	}
+	return nil
+}
+
+func scanSavedQuery(rows *sql.Rows) (models.SavedQuery, error) {
+	var savedQuery models.SavedQuery
+	var series, flux sql.NullString
+	var updated int64
+	err := rows.Scan(&savedQuery.Id, &savedQuery.Owner, &savedQuery.Name, &series, &flux, &updated)
+	if err != nil {
+		return models.SavedQuery{}, err
+	}
+	if series.Valid && series.String != "" {
+		savedQuery.Series = &models.SeriesQuery{}
+		if err := json.Unmarshal([]byte(series.String), savedQuery.Series); err != nil {
+			return models.SavedQuery{}, err
+		}
+	}
+	savedQuery.Flux = flux.String
+	savedQuery.Updated = time.UnixMilli(updated)
+	return savedQuery, nil
+}
+
+func GetSavedQueries(username string) ([]models.SavedQuery, error) {
+	//own queries and the ones shared with username
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return []models.SavedQuery{}, fmt.Errorf("getSavedQueries: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, owner, name, series, flux, updated FROM sys.SavedQueries WHERE owner = ? OR id IN (SELECT itemId FROM sys.DashboardShares WHERE kind = ? AND username = ?) ORDER BY name", username, shareQuery, username)
+	if err != nil {
+		return []models.SavedQuery{}, fmt.Errorf("getSavedQueries: %s", err)
+	}
+	defer rows.Close()
+
+	savedQueries := make([]models.SavedQuery, 0)
+	for rows.Next() {
+		savedQuery, err := scanSavedQuery(rows)
+		if err != nil {
+			return []models.SavedQuery{}, fmt.Errorf("getSavedQueries: %s", err)
+		}
+		savedQueries = append(savedQueries, savedQuery)
+	}
+	rows.Close()
+
+	for i := range savedQueries {
+		savedQueries[i].SharedWith, err = getShares(db, shareQuery, savedQueries[i].Id)
+		if err != nil {
+			return []models.SavedQuery{}, fmt.Errorf("getSavedQueries: %s", err)
+		}
+	}
+	return savedQueries, nil
+}
+
+func GetSavedQuery(id int, username string) (models.SavedQuery, error) {
+	//a query username owns or was shared with
+	savedQueries, err := GetSavedQueries(username)
+	if err != nil {
+		return models.SavedQuery{}, err
+	}
+	for _, savedQuery := range savedQueries {
+		if savedQuery.Id == id {
+			return savedQuery, nil
+		}
+	}
+	return models.SavedQuery{}, ErrDashboardNotFound
+}
+
+func SetSavedQuery(savedQuery models.SavedQuery, username string) (int, error) {
+	//create a query without id, otherwise update it as its owner
+	if savedQuery.Name == "" {
+		return 0, fmt.Errorf("%w: no name", ErrDashboardValue)
+	}
+	if (savedQuery.Series == nil) == (savedQuery.Flux == "") {
+		return 0, fmt.Errorf("%w: a query needs either series or flux", ErrDashboardValue)
+	}
+	var series sql.NullString
+	if savedQuery.Series != nil {
+		err := query.CheckSeriesAllowed(savedQuery.Series.Series)
+		if err == nil {
+			_, err = query.BuildSeriesQuery(*savedQuery.Series)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", ErrDashboardValue, err)
+		}
+		definition, err := json.Marshal(savedQuery.Series)
+		if err != nil {
+			return 0, fmt.Errorf("setSavedQuery: %s", err)
+		}
+		series = sql.NullString{String: string(definition), Valid: true}
+	}
+
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return 0, fmt.Errorf("setSavedQuery: %s", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("setSavedQuery: %s", err)
+	}
+	defer tx.Rollback()
+
+	updated := time.Now().UnixMilli()
+	if savedQuery.Id == 0 {
+		result, err := tx.Exec("INSERT INTO sys.SavedQueries (owner, name, series, flux, updated) VALUES (?, ?, ?, ?, ?)", username, savedQuery.Name, series, savedQuery.Flux, updated)
+		if err != nil {
+			return 0, fmt.Errorf("setSavedQuery: %s", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, fmt.Errorf("setSavedQuery: %s", err)
+		}
+		savedQuery.Id = int(id)
+	} else {
+		if err := checkOwner(tx, "SavedQueries", savedQuery.Id, username); err != nil {
+			return 0, err
+		}
+		_, err := tx.Exec("UPDATE sys.SavedQueries SET name = ?, series = ?, flux = ?, updated = ? WHERE id = ?", savedQuery.Name, series, savedQuery.Flux, updated, savedQuery.Id)
+		if err != nil {
+			return 0, fmt.Errorf("setSavedQuery: %s", err)
+		}
+	}
+
+	if savedQuery.SharedWith != nil {
+		if err := setShares(tx, shareQuery, savedQuery.Id, savedQuery.SharedWith); err != nil {
+			return 0, err
+		}
+	}
+	return savedQuery.Id, tx.Commit()
+}
+
+func DeleteSavedQuery(id int, username string) error {
+	return deleteItem("SavedQueries", shareQuery, id, username)
+}
+
+func deleteItem(table string, kind string, id int, username string) error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("deleteItem: %s", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("deleteItem: %s", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkOwner(tx, table, id, username); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sys."+table+" WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("deleteItem: %s", err)
+	}
+	_, err = tx.Exec("DELETE FROM sys.DashboardShares WHERE kind = ? AND itemId = ?", kind, id)
+	if err != nil {
+		return fmt.Errorf("deleteItem: %s", err)
+	}
+	return tx.Commit()
+}
+
+func RunSavedQuery(ctx context.Context, session_token string, username string, id int, t map[string]interface{}) (interface{}, error) {
+	//run a saved query with the influxdb token of the caller, given up when ctx ends
+	savedQuery, err := GetSavedQuery(id, username)
+	if err != nil {
+		return nil, err
+	}
+
+	queryStr := savedQuery.Flux
+	if savedQuery.Series != nil {
+		seriesQuery := *savedQuery.Series
+		if err := query.CheckSeriesAllowed(seriesQuery.Series); err != nil {
+			return nil, err
+		}
+		if points := query.TargetPoints(t); points > 0 {
+			seriesQuery.Points = points
+		}
+		queryStr, err = query.BuildSeriesQuery(seriesQuery)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		is_allowed, err := query.RawQueryAllowed(session_token)
+		if err != nil {
+			return nil, err
+		}
+		if !is_allowed {
+			return nil, fmt.Errorf("%w: raw flux queries are only allowed for admins", query.ErrSeriesNotAllowed)
+		}
+	}
+	return query.RunQuery(ctx, session_token, queryStr, t)
+}
+
+func GetDashboards(username string) ([]models.Dashboard, error) {
+	//own dashboards and the ones shared with username
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return []models.Dashboard{}, fmt.Errorf("getDashboards: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, owner, name, layout, updated FROM sys.Dashboards WHERE owner = ? OR id IN (SELECT itemId FROM sys.DashboardShares WHERE kind = ? AND username = ?) ORDER BY name", username, shareDashboard, username)
+	if err != nil {
+		return []models.Dashboard{}, fmt.Errorf("getDashboards: %s", err)
+	}
+	defer rows.Close()
+
+	dashboards := make([]models.Dashboard, 0)
+	for rows.Next() {
+		var dashboard models.Dashboard
+		var layout string
+		var updated int64
+		err := rows.Scan(&dashboard.Id, &dashboard.Owner, &dashboard.Name, &layout, &updated)
+		if err != nil {
+			return []models.Dashboard{}, fmt.Errorf("getDashboards: %s", err)
+		}
+		dashboard.Layout = json.RawMessage(layout)
+		dashboard.Updated = time.UnixMilli(updated)
+		dashboards = append(dashboards, dashboard)
+	}
+	rows.Close()
+
+	for i := range dashboards {
+		dashboards[i].SharedWith, err = getShares(db, shareDashboard, dashboards[i].Id)
+		if err != nil {
+			return []models.Dashboard{}, fmt.Errorf("getDashboards: %s", err)
+		}
+	}
+	return dashboards, nil
+}
+
+func SetDashboard(dashboard models.Dashboard, username string) (int, error) {
+	//create a dashboard without id, otherwise update it as its owner, the
+	//layout is kept as the client sends it
+	if dashboard.Name == "" {
+		return 0, fmt.Errorf("%w: no name", ErrDashboardValue)
+	}
+	//an update without layout only renames
+	keepLayout := len(dashboard.Layout) == 0
+	if keepLayout {
+		dashboard.Layout = json.RawMessage("{}")
+	}
+	if !json.Valid(dashboard.Layout) {
+		return 0, fmt.Errorf("%w: layout is no json", ErrDashboardValue)
+	}
+
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return 0, fmt.Errorf("setDashboard: %s", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("setDashboard: %s", err)
+	}
+	defer tx.Rollback()
+
+	updated := time.Now().UnixMilli()
+	if dashboard.Id == 0 {
+		result, err := tx.Exec("INSERT INTO sys.Dashboards (owner, name, layout, updated) VALUES (?, ?, ?, ?)", username, dashboard.Name, string(dashboard.Layout), updated)
+		if err != nil {
+			return 0, fmt.Errorf("setDashboard: %s", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, fmt.Errorf("setDashboard: %s", err)
+		}
+		dashboard.Id = int(id)
+	} else {
+		if err := checkOwner(tx, "Dashboards", dashboard.Id, username); err != nil {
+			return 0, err
+		}
+		var err error
+		if keepLayout {
+			_, err = tx.Exec("UPDATE sys.Dashboards SET name = ?, updated = ? WHERE id = ?", dashboard.Name, updated, dashboard.Id)
+		} else {
+			_, err = tx.Exec("UPDATE sys.Dashboards SET name = ?, layout = ?, updated = ? WHERE id = ?", dashboard.Name, string(dashboard.Layout), updated, dashboard.Id)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("setDashboard: %s", err)
+		}
+	}
+
+	if dashboard.SharedWith != nil {
+		if err := setShares(tx, shareDashboard, dashboard.Id, dashboard.SharedWith); err != nil {
+			return 0, err
+		}
+	}
+	return dashboard.Id, tx.Commit()
+}
+
+func DeleteDashboard(id int, username string) error {
+	return deleteItem("Dashboards", shareDashboard, id, username)
+}
+
+func sessionUser(w http.ResponseWriter, session_token string) (string, bool) {
+	//username of a valid session, sends the error response otherwise
+	if session_token == "" {
+		tools.SendError(w, http.StatusUnauthorized, errors.New("no session token"))
+		return "", false
+	}
+	is_valid, err := tools.CheckSession(session_token)
+	if err != nil {
+		tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+		return "", false
+	}
+	if !is_valid {
+		tools.SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+		return "", false
+	}
+	username, err := tools.GetUsernameFromSession(session_token)
+	if err != nil {
+		tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting username: %s", err))
+		return "", false
+	}
+	return username, true
+}
+
+func sendDashboardError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrDashboardNotFound):
+		tools.SendError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrDashboardOwner), errors.Is(err, query.ErrSeriesNotAllowed):
+		tools.SendError(w, http.StatusForbidden, err)
+	case errors.Is(err, ErrDashboardValue), errors.Is(err, query.ErrSeriesQuery):
+		tools.SendError(w, http.StatusBadRequest, err)
+	case errors.Is(err, query.ErrQueryTimeout), errors.Is(err, query.ErrQueryTooLarge), errors.Is(err, context.Canceled):
+		query.SendQueryError(w, err)
+	default:
+		tools.SendError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func sharedWith(t map[string]interface{}) []string {
+	//nil keeps the current shares, a list replaces them
+	rawShares, ok := t["sharedWith"].([]interface{})
+	if !ok {
+		return nil
+	}
+	usernames := make([]string, 0)
+	for _, rawShare := range rawShares {
+		if username, ok := rawShare.(string); ok && username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+func SavedQueries(w http.ResponseWriter, r *http.Request) {
+	//saved queries of the account, shared ones included
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		username, ok := sessionUser(w, r.URL.Query().Get("session_token"))
+		if !ok {
+			return
+		}
+		savedQueries, err := GetSavedQueries(username)
+		if err != nil {
+			sendDashboardError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(savedQueries)
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		session_token, _ := t["session_token"].(string)
+		username, ok := sessionUser(w, session_token)
+		if !ok {
+			return
+		}
+
+		id, _ := t["id"].(float64)
+		if remove, _ := t["delete"].(bool); remove {
+			err = DeleteSavedQuery(int(id), username)
+			if err != nil {
+				sendDashboardError(w, err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+			return
+		}
+
+		savedQuery := models.SavedQuery{Id: int(id), SharedWith: sharedWith(t)}
+		savedQuery.Name, _ = t["name"].(string)
+		savedQuery.Flux, _ = t["flux"].(string)
+		if rawSeries, ok := t["series"].(map[string]interface{}); ok {
+			seriesQuery := query.SeriesQueryFromRequest(rawSeries)
+			savedQuery.Series = &seriesQuery
+		}
+
+		//raw flux is only saved by those who may run it
+		if savedQuery.Flux != "" {
+			is_allowed, err := query.RawQueryAllowed(session_token)
+			if err != nil {
+				tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking admin: %s", err))
+				return
+			}
+			if !is_allowed {
+				tools.SendError(w, http.StatusForbidden, errors.New("raw flux queries are only allowed for admins"))
+				return
+			}
+		}
+
+		savedId, err := SetSavedQuery(savedQuery, username)
+		if err != nil {
+			sendDashboardError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int{"id": savedId})
+	default:
+		log.Printf(models.Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + models.Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(models.ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}
+
+func RunQuery(w http.ResponseWriter, r *http.Request) {
+	//run a saved query by id, version and points work as for /query
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		session_token, _ := t["session_token"].(string)
+		username, ok := sessionUser(w, session_token)
+		if !ok {
+			return
+		}
+
+		id, _ := t["id"].(float64)
+		resp, err := RunSavedQuery(r.Context(), session_token, username, int(id), t)
+		if err != nil {
+			sendDashboardError(w, fmt.Errorf("error running query %s: %w", strconv.Itoa(int(id)), err))
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	default:
+		log.Printf(models.Red + "Sorry, only POST method is supported.\n" + r.Method + models.Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(models.ErrorResponse{Error: "Sorry, only POST method is supported."})
+	}
+}
+
+func Dashboards(w http.ResponseWriter, r *http.Request) {
+	//dashboard layouts of the account, shared ones included
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		username, ok := sessionUser(w, r.URL.Query().Get("session_token"))
+		if !ok {
+			return
+		}
+		dashboards, err := GetDashboards(username)
+		if err != nil {
+			sendDashboardError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(dashboards)
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		session_token, _ := t["session_token"].(string)
+		username, ok := sessionUser(w, session_token)
+		if !ok {
+			return
+		}
+
+		id, _ := t["id"].(float64)
+		if remove, _ := t["delete"].(bool); remove {
+			err = DeleteDashboard(int(id), username)
+			if err != nil {
+				sendDashboardError(w, err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+			return
+		}
+
+		dashboard := models.Dashboard{Id: int(id), SharedWith: sharedWith(t)}
+		dashboard.Name, _ = t["name"].(string)
+		if layout, ok := t["layout"]; ok {
+			dashboard.Layout, err = json.Marshal(layout)
+			if err != nil {
+				tools.SendError(w, http.StatusBadRequest, fmt.Errorf("error encoding layout: %s", err))
+				return
+			}
+		}
+
+		savedId, err := SetDashboard(dashboard, username)
+		if err != nil {
+			sendDashboardError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int{"id": savedId})
+	default:
+		log.Printf(models.Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + models.Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(models.ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}
@@ -0,0 +1,580 @@
+package heizung
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "github.com/GineHyte/server/models"
+	query "github.com/GineHyte/server/utils/query"
+	schalter "github.com/GineHyte/server/utils/schalter"
+	tools "github.com/GineHyte/server/utils/tools"
+)
+
+var ErrHeizungValue = errors.New("invalid heizung value")
+
+// valves of pid rooms are switched on for output percent of every cycle
+var pidCycle = 10 * time.Minute
+
+// a temperature drop this fast means an open window
+var windowDropPeriod = 10 * time.Minute
+var windowOpenTime = 15 * time.Minute
+
+// controller state of every room by room name
+type roomState struct {
+	status      models.HeizungStatus
+	integral    float64
+	lastError   float64
+	lastTime    time.Time
+	windowUntil time.Time
+}
+
+var rooms = make(map[string]*roomState)
+var mu sync.Mutex
+
+func CreateHeizungTables() error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("createHeizungTables: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.HeizungRooms (room VARCHAR(255) NOT NULL PRIMARY KEY, sensor VARCHAR(255) NOT NULL, valves VARCHAR(1024) NOT NULL, windowSeries VARCHAR(255) NOT NULL DEFAULT '', target DOUBLE NOT NULL, hysteresis DOUBLE NOT NULL, mode VARCHAR(32) NOT NULL, kp DOUBLE NOT NULL DEFAULT 0, ki DOUBLE NOT NULL DEFAULT 0, kd DOUBLE NOT NULL DEFAULT 0, enabled BOOL NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("createHeizungTables: %s", err)
+	}
+
+	//weekday 0 is sunday, -1 is every day
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.HeizungSchedule (room VARCHAR(255) NOT NULL, weekday INT NOT NULL, start VARCHAR(5) NOT NULL, target DOUBLE NOT NULL, PRIMARY KEY (room, weekday, start))")
+	if err != nil {
+		return fmt.Errorf("createHeizungTables: %s", err)
+	}
+
+	return nil
+}
+
+func GetHeizungRooms() ([]models.HeizungRoom, error) {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return []models.HeizungRoom{}, fmt.Errorf("getHeizungRooms: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT room, sensor, valves, windowSeries, target, hysteresis, mode, kp, ki, kd, enabled FROM sys.HeizungRooms ORDER BY room")
+	if err != nil {
+		return []models.HeizungRoom{}, fmt.Errorf("getHeizungRooms: %s", err)
+	}
+	defer rows.Close()
+
+	heizungRooms := make([]models.HeizungRoom, 0)
+	for rows.Next() {
+		var room models.HeizungRoom
+		var valves string
+		err := rows.Scan(&room.Room, &room.Sensor, &valves, &room.Window, &room.Target, &room.Hysteresis, &room.Mode, &room.Kp, &room.Ki, &room.Kd, &room.Enabled)
+		if err != nil {
+			return []models.HeizungRoom{}, fmt.Errorf("getHeizungRooms: %s", err)
+		}
+		room.Valves = make([]string, 0)
+		for _, valve := range strings.Split(valves, ",") {
+			if valve != "" {
+				room.Valves = append(room.Valves, valve)
+			}
+		}
+		heizungRooms = append(heizungRooms, room)
+	}
+
+	return heizungRooms, nil
+}
+
+func SetHeizungRoom(room models.HeizungRoom) error {
+	if room.Sensor == "" || len(room.Valves) == 0 {
+		return fmt.Errorf("%w: a room needs a sensor and valves", ErrHeizungValue)
+	}
+	if room.Mode == "" {
+		room.Mode = models.HeizungHysteresis
+	}
+	if room.Mode != models.HeizungHysteresis && room.Mode != models.HeizungPID {
+		return fmt.Errorf("%w: unknown mode %s", ErrHeizungValue, room.Mode)
+	}
+	if room.Hysteresis <= 0 {
+		room.Hysteresis = 0.5
+	}
+	if err := checkTarget(room.Target); err != nil {
+		return err
+	}
+
+	//valves without a type would be driven as shutter motors
+	for _, valve := range room.Valves {
+		status, err := schalter.GetSchalterStatus(valve)
+		if err != nil {
+			return fmt.Errorf("%w: unknown valve %s", ErrHeizungValue, valve)
+		}
+		if !isValveType(status.Type) {
+			return fmt.Errorf("%w: valve %s is a %s, set its type to %s or %s", ErrHeizungValue, valve, status.Type, models.TypeSwitch, models.TypeDimmer)
+		}
+	}
+
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("setHeizungRoom: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO sys.HeizungRooms (room, sensor, valves, windowSeries, target, hysteresis, mode, kp, ki, kd, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE sensor = VALUES(sensor), valves = VALUES(valves), windowSeries = VALUES(windowSeries), target = VALUES(target), hysteresis = VALUES(hysteresis), mode = VALUES(mode), kp = VALUES(kp), ki = VALUES(ki), kd = VALUES(kd), enabled = VALUES(enabled)",
+		room.Room, room.Sensor, strings.Join(room.Valves, ","), room.Window, room.Target, room.Hysteresis, room.Mode, room.Kp, room.Ki, room.Kd, room.Enabled)
+	if err != nil {
+		return fmt.Errorf("setHeizungRoom: %s", err)
+	}
+
+	return nil
+}
+
+func DeleteHeizungRoom(name string) error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("deleteHeizungRoom: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM sys.HeizungRooms WHERE room = ?", name)
+	if err != nil {
+		return fmt.Errorf("deleteHeizungRoom: %s", err)
+	}
+	_, err = db.Exec("DELETE FROM sys.HeizungSchedule WHERE room = ?", name)
+	if err != nil {
+		return fmt.Errorf("deleteHeizungRoom: %s", err)
+	}
+
+	mu.Lock()
+	delete(rooms, name)
+	mu.Unlock()
+
+	return nil
+}
+
+func GetHeizungSchedule(room string) ([]models.HeizungSchedule, error) {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return []models.HeizungSchedule{}, fmt.Errorf("getHeizungSchedule: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT room, weekday, start, target FROM sys.HeizungSchedule WHERE room = ? ORDER BY weekday, start", room)
+	if err != nil {
+		return []models.HeizungSchedule{}, fmt.Errorf("getHeizungSchedule: %s", err)
+	}
+	defer rows.Close()
+
+	schedule := make([]models.HeizungSchedule, 0)
+	for rows.Next() {
+		var entry models.HeizungSchedule
+		err := rows.Scan(&entry.Room, &entry.Weekday, &entry.Start, &entry.Target)
+		if err != nil {
+			return []models.HeizungSchedule{}, fmt.Errorf("getHeizungSchedule: %s", err)
+		}
+		schedule = append(schedule, entry)
+	}
+
+	return schedule, nil
+}
+
+func checkTarget(target float64) error {
+	//rooms and schedules only heat to a target between 5 and 30 °C
+	if target < 5 || target > 30 {
+		return fmt.Errorf("%w: target %s is not between 5 and 30", ErrHeizungValue, strconv.FormatFloat(target, 'f', -1, 64))
+	}
+	return nil
+}
+
+func SetHeizungSchedule(room string, schedule []models.HeizungSchedule) error {
+	for _, entry := range schedule {
+		if entry.Weekday < -1 || entry.Weekday > 6 {
+			return fmt.Errorf("%w: weekday %d is not between -1 and 6", ErrHeizungValue, entry.Weekday)
+		}
+		if _, err := time.Parse("15:04", entry.Start); err != nil {
+			return fmt.Errorf("%w: start %s is not HH:MM", ErrHeizungValue, entry.Start)
+		}
+		if err := checkTarget(entry.Target); err != nil {
+			return err
+		}
+	}
+
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("setHeizungSchedule: %s", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("setHeizungSchedule: %s", err)
+	}
+	defer tx.Rollback()
+
+	//replace the whole schedule of the room
+	_, err = tx.Exec("DELETE FROM sys.HeizungSchedule WHERE room = ?", room)
+	if err != nil {
+		return fmt.Errorf("setHeizungSchedule: %s", err)
+	}
+	for _, entry := range schedule {
+		_, err = tx.Exec("INSERT INTO sys.HeizungSchedule (room, weekday, start, target) VALUES (?, ?, ?, ?)", room, entry.Weekday, entry.Start, entry.Target)
+		if err != nil {
+			return fmt.Errorf("setHeizungSchedule: %s", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func scheduledTarget(room models.HeizungRoom, schedule []models.HeizungSchedule, now time.Time) float64 {
+	//the last schedule entry that started before now, the room target without one
+	for daysBack := 0; daysBack <= 7; daysBack++ {
+		day := now.AddDate(0, 0, -daysBack)
+		latest := ""
+		target := room.Target
+		for _, entry := range schedule {
+			if entry.Weekday != -1 && entry.Weekday != int(day.Weekday()) {
+				continue
+			}
+			if daysBack == 0 && entry.Start > now.Format("15:04") {
+				continue
+			}
+			if entry.Start >= latest {
+				latest = entry.Start
+				target = entry.Target
+			}
+		}
+		if latest != "" {
+			return target
+		}
+	}
+	return room.Target
+}
+
+func heizungInterval() time.Duration {
+	interval, err := strconv.Atoi(os.Getenv("HEIZUNG_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(interval) * time.Second
+}
+
+func HeizungJob() {
+	//control every enabled room
+	for {
+		heizungRooms, err := GetHeizungRooms()
+		if err != nil {
+			log.Printf(models.Red+"error getting heizung rooms: %s\n"+models.Reset, err)
+		}
+		for _, room := range heizungRooms {
+			if !room.Enabled {
+				continue
+			}
+			schedule, err := GetHeizungSchedule(room.Room)
+			if err != nil {
+				log.Printf(models.Red+"error getting heizung schedule: %s\n"+models.Reset, err)
+			}
+			controlRoom(room, schedule, time.Now())
+		}
+		time.Sleep(heizungInterval())
+	}
+}
+
+func getRoomState(room string) *roomState {
+	//callers hold mu
+	state, ok := rooms[room]
+	if !ok {
+		state = &roomState{}
+		rooms[room] = state
+	}
+	return state
+}
+
+func controlRoom(room models.HeizungRoom, schedule []models.HeizungSchedule, now time.Time) {
+	target := scheduledTarget(room, schedule, now)
+	values, err := seriesValues(room.Sensor, windowDropPeriod)
+
+	mu.Lock()
+	state := getRoomState(room.Room)
+	state.status.Room = room
+	state.status.Schedule = schedule
+	state.status.Target = target
+	state.status.Checked = &now
+	if err != nil {
+		//without a temperature the valves stay as they are
+		state.status.LastError = err.Error()
+		mu.Unlock()
+		log.Printf(models.Red+"heizung %s: %s\n"+models.Reset, room.Room, err)
+		return
+	}
+	current := values[len(values)-1]
+	state.status.Current = &current
+	state.status.LastError = ""
+	mu.Unlock()
+
+	windowOpen := windowIsOpen(room, values, state, now)
+
+	mu.Lock()
+	state.status.WindowOpen = windowOpen
+	heating := state.status.Heating
+	output := 0.0
+	switch {
+	case windowOpen:
+		heating = false
+		state.integral = 0
+	case room.Mode == models.HeizungPID:
+		output = pidOutput(room, state, target-current, now)
+		heating = now.Sub(now.Truncate(pidCycle)) < time.Duration(output/100*float64(pidCycle))
+	case current < target-room.Hysteresis:
+		heating = true
+	case current > target+room.Hysteresis:
+		heating = false
+	}
+	state.status.Heating = heating
+	state.status.Output = output
+	mu.Unlock()
+
+	driveValves(room, heating, output)
+}
+
+func pidOutput(room models.HeizungRoom, state *roomState, e float64, now time.Time) float64 {
+	//valve opening in percent, callers hold mu
+	dt := now.Sub(state.lastTime).Minutes()
+	if state.lastTime.IsZero() || dt <= 0 {
+		dt = heizungInterval().Minutes()
+		state.lastError = e
+	}
+	derivative := (e - state.lastError) / dt
+	state.integral += e * dt
+
+	//anti windup, the integral alone never asks for more than a fully open valve
+	if room.Ki > 0 {
+		state.integral = math.Max(0, math.Min(state.integral, 100/room.Ki))
+	}
+	state.lastError = e
+	state.lastTime = now
+
+	output := room.Kp*e + room.Ki*state.integral + room.Kd*derivative
+	return math.Max(0, math.Min(output, 100))
+}
+
+func windowIsOpen(room models.HeizungRoom, values []float64, state *roomState, now time.Time) bool {
+	//a window contact wins, otherwise a fast temperature drop counts as open
+	if room.Window != "" {
+		contact, err := seriesValues(room.Window, windowDropPeriod)
+		if err == nil {
+			return contact[len(contact)-1] > 0
+		}
+		log.Printf(models.Red+"heizung %s: window: %s\n"+models.Reset, room.Room, err)
+	}
+
+	drop, err := strconv.ParseFloat(os.Getenv("HEIZUNG_WINDOW_DROP"), 64)
+	if err != nil || drop <= 0 {
+		drop = 1.0
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if values[0]-values[len(values)-1] >= drop {
+		state.windowUntil = now.Add(windowOpenTime)
+	}
+	return now.Before(state.windowUntil)
+}
+
+func seriesValues(name string, period time.Duration) ([]float64, error) {
+	//values of a series in the last period, oldest first
+	bucket := os.Getenv("HEIZUNG_BUCKET")
+	if bucket == "" {
+		bucket = "lcn"
+	}
+	queryStr := fmt.Sprintf("from(bucket: %s)\n"+
+		"|> range(start: -%ds)\n"+
+		"|> filter(fn: (r) => r[\"_measurement\"] == %s)\n"+
+		"|> filter(fn: (r) => r[\"name\"] == %s)", query.FluxString(bucket), int(period.Seconds()), query.FluxString(bucket), query.FluxString(name))
+
+	resp, err := query.QueryInfluxDBWithToken(os.Getenv("ADMIN_TOKEN"), queryStr)
+	if err != nil {
+		return []float64{}, err
+	}
+	if len(resp.LineSets) == 0 || len(resp.LineSets[0]) == 0 {
+		return []float64{}, fmt.Errorf("no data for %s", name)
+	}
+
+	values := make([]float64, 0, len(resp.LineSets[0]))
+	for _, pair := range resp.LineSets[0] {
+		values = append(values, pair.Value)
+	}
+	return values, nil
+}
+
+func driveValves(room models.HeizungRoom, heating bool, output float64) {
+	//valves run as schedule so a manual command always wins
+	owner := models.SchalterSource{Type: models.SourceSchedule, Id: "heizung:" + room.Room}
+	for _, valve := range room.Valves {
+		state := "OFF"
+		if heating {
+			state = "ON"
+		}
+
+		//the type may have changed since the room was saved
+		status, err := schalter.GetSchalterStatus(valve)
+		if err != nil {
+			log.Printf(models.Red+"heizung %s: error getting valve %s: %s\n"+models.Reset, room.Room, valve, err)
+			continue
+		}
+		if !isValveType(status.Type) {
+			log.Printf(models.Red+"heizung %s: valve %s is a %s, not switching it\n"+models.Reset, room.Room, valve, status.Type)
+			continue
+		}
+
+		//dimmable valves take the pid output directly
+		if room.Mode == models.HeizungPID && status.Type == models.TypeDimmer {
+			state = strconv.FormatFloat(math.Round(output), 'f', -1, 64)
+		}
+
+		err = schalter.RunSchalterCommand(models.SchalterStatus{Name: valve, State: state}, owner)
+		if err != nil && !errors.Is(err, schalter.ErrSchalterAlreadySet) && !errors.Is(err, schalter.ErrSchalterLocked) {
+			log.Printf(models.Red+"heizung %s: error switching %s: %s\n"+models.Reset, room.Room, valve, err)
+		}
+	}
+}
+
+func isValveType(deviceType string) bool {
+	return deviceType == models.TypeSwitch || deviceType == models.TypeDimmer
+}
+
+func GetHeizungStatuses() ([]models.HeizungStatus, error) {
+	heizungRooms, err := GetHeizungRooms()
+	if err != nil {
+		return []models.HeizungStatus{}, err
+	}
+
+	statuses := make([]models.HeizungStatus, 0, len(heizungRooms))
+	for _, room := range heizungRooms {
+		schedule, err := GetHeizungSchedule(room.Room)
+		if err != nil {
+			return []models.HeizungStatus{}, err
+		}
+
+		mu.Lock()
+		status := models.HeizungStatus{Target: room.Target}
+		if state, ok := rooms[room.Room]; ok {
+			status = state.status
+		}
+		mu.Unlock()
+
+		status.Room = room
+		status.Schedule = schedule
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func Heizung(w http.ResponseWriter, r *http.Request) {
+	//heating rooms and schedules with session token
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		statuses, err := GetHeizungStatuses()
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting heizung: %s", err))
+			return
+		}
+		json.NewEncoder(w).Encode(statuses)
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			tools.SendError(w, http.StatusBadRequest, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := tools.CheckSession(session_token)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			tools.SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//check if room is valid
+		name, _ := t["room"].(string)
+		if name == "" {
+			tools.SendError(w, http.StatusBadRequest, errors.New("no room"))
+			return
+		}
+
+		//a room is deleted, gets a new schedule or a new configuration
+		if remove, _ := t["delete"].(bool); remove {
+			err = DeleteHeizungRoom(name)
+		} else if rawSchedule, ok := t["schedule"].([]interface{}); ok {
+			schedule := make([]models.HeizungSchedule, 0)
+			for _, rawEntry := range rawSchedule {
+				entry, _ := rawEntry.(map[string]interface{})
+				weekday, _ := entry["weekday"].(float64)
+				start, _ := entry["start"].(string)
+				target, _ := entry["target"].(float64)
+				schedule = append(schedule, models.HeizungSchedule{Room: name, Weekday: int(weekday), Start: start, Target: target})
+			}
+			err = SetHeizungSchedule(name, schedule)
+		} else {
+			room := models.HeizungRoom{Room: name, Valves: make([]string, 0), Enabled: true}
+			room.Sensor, _ = t["sensor"].(string)
+			room.Window, _ = t["window"].(string)
+			room.Target, _ = t["target"].(float64)
+			room.Hysteresis, _ = t["hysteresis"].(float64)
+			room.Mode, _ = t["mode"].(string)
+			room.Kp, _ = t["kp"].(float64)
+			room.Ki, _ = t["ki"].(float64)
+			room.Kd, _ = t["kd"].(float64)
+			if enabled, ok := t["enabled"].(bool); ok {
+				room.Enabled = enabled
+			}
+			rawValves, _ := t["valves"].([]interface{})
+			for _, rawValve := range rawValves {
+				if valve, ok := rawValve.(string); ok && valve != "" {
+					room.Valves = append(room.Valves, valve)
+				}
+			}
+			err = SetHeizungRoom(room)
+		}
+		if errors.Is(err, ErrHeizungValue) {
+			tools.SendError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error setting heizung: %s", err))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	default:
+		log.Printf(models.Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + models.Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(models.ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}
@@ -36,30 +36,10 @@ func Mail(w http.ResponseWriter, r *http.Request) {
 		html := t["html"].(string)
 
 		// send mail
-		mailjetClient := mailjet.NewMailjetClient(os.Getenv("MAILJET_API_PUBLIC"), os.Getenv("MAILJET_API_PRIVATE"))
-		messagesInfo := []mailjet.InfoMessagesV31{
-			{
-				From: &mailjet.RecipientV31{
-					Email: from,
-					Name:  "Klingel",
-				},
-				To: &mailjet.RecipientsV31{
-					mailjet.RecipientV31{
-						Email: to,
-						Name:  "info",
-					},
-				},
-				Subject:  subject,
-				TextPart: text,
-				HTMLPart: html,
-			},
-		}
-		messages := mailjet.MessagesV31{Info: messagesInfo}
-		res, err := mailjetClient.SendMailV31(&messages)
+		err = SendMail(from, to, subject, text, html)
 		if err != nil {
 			log.Fatal(err)
 		}
-		fmt.Printf("Data: %+v\n", res)
 
 		// send response
 		w.Header().Set("Content-Type", "application/json")
@@ -72,6 +52,34 @@ func Mail(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func SendMail(from string, to string, subject string, text string, html string) error {
+	mailjetClient := mailjet.NewMailjetClient(os.Getenv("MAILJET_API_PUBLIC"), os.Getenv("MAILJET_API_PRIVATE"))
+	messagesInfo := []mailjet.InfoMessagesV31{
+		{
+			From: &mailjet.RecipientV31{
+				Email: from,
+				Name:  "Klingel",
+			},
+			To: &mailjet.RecipientsV31{
+				mailjet.RecipientV31{
+					Email: to,
+					Name:  "info",
+				},
+			},
+			Subject:  subject,
+			TextPart: text,
+			HTMLPart: html,
+		},
+	}
+	messages := mailjet.MessagesV31{Info: messagesInfo}
+	res, err := mailjetClient.SendMailV31(&messages)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Data: %+v\n", res)
+	return nil
+}
+
 func Klingel(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
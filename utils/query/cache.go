@@ -0,0 +1,209 @@
+package Query
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+// results are cached per influxdb token and normalised flux for one time
+// bucket of QUERY_CACHE_TTL, so relative ranges like -1h are shared by every
+// request inside the same bucket
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+type queryCache struct {
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	order     *list.List
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+var cache = &queryCache{entries: make(map[string]*list.Element), order: list.New()}
+
+func cacheTTL() time.Duration {
+	//QUERY_CACHE_TTL in seconds, 0 turns the cache off
+	ttl, err := strconv.Atoi(os.Getenv("QUERY_CACHE_TTL"))
+	if err != nil || ttl < 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func cacheSize() int {
+	size, err := strconv.Atoi(os.Getenv("QUERY_CACHE_SIZE"))
+	if err != nil || size <= 0 {
+		return 500
+	}
+	return size
+}
+
+func normaliseFlux(Query string) string {
+	//collapse whitespace outside of string literals, absolute timestamps stay
+	//as they are so different ranges never share a key
+	var builder strings.Builder
+	inString, escaped, space := false, false, false
+	for _, c := range strings.TrimSpace(Query) {
+		switch {
+		case inString:
+			if c == '"' && !escaped {
+				inString = false
+			}
+			escaped = c == '\\' && !escaped
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			continue
+		case c == '"':
+			inString = true
+		}
+		if space {
+			builder.WriteByte(' ')
+			space = false
+		}
+		builder.WriteRune(c)
+	}
+
+	return builder.String()
+}
+
+func cachedQuery(kind string, influx_token string, Query string, run func() (interface{}, error)) (interface{}, error) {
+	//result of run from the cache or run and remember it
+	ttl := cacheTTL()
+	if ttl == 0 {
+		return run()
+	}
+	bucket := time.Now().Truncate(ttl)
+	key := kind + "\x00" + influx_token + "\x00" + strconv.FormatInt(bucket.Unix(), 10) + "\x00" + normaliseFlux(Query)
+
+	cache.mu.Lock()
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			cache.order.MoveToFront(element)
+			cache.hits++
+			cache.mu.Unlock()
+			return entry.value, nil
+		}
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+	}
+	cache.misses++
+	cache.mu.Unlock()
+
+	value, err := run()
+	if err != nil {
+		return value, err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.order.Remove(element)
+	}
+	cache.entries[key] = cache.order.PushFront(&cacheEntry{key: key, value: value, expires: bucket.Add(ttl)})
+
+	//the least recently used entries go first
+	for size := cacheSize(); cache.order.Len() > size; {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+		cache.evictions++
+	}
+	return value, nil
+}
+
+func ClearQueryCache() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.entries = make(map[string]*list.Element)
+	cache.order.Init()
+}
+
+func GetQueryCacheStats() QueryCacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	stats := QueryCacheStats{
+		Entries:    cache.order.Len(),
+		MaxEntries: cacheSize(),
+		TTL:        int(cacheTTL().Seconds()),
+		Hits:       cache.hits,
+		Misses:     cache.misses,
+		Evictions:  cache.evictions,
+	}
+	if total := cache.hits + cache.misses; total > 0 {
+		stats.HitRate = float64(cache.hits) / float64(total)
+	}
+	return stats
+}
+
+func QueryCache(w http.ResponseWriter, r *http.Request) {
+	//cache statistics, admins can clear the cache
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(GetQueryCacheStats())
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			SendError(w, http.StatusUnauthorized, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//only admins clear the cache
+		is_admin, err := IsAdmin(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking admin: %s", err))
+			return
+		}
+		if !is_admin {
+			SendError(w, http.StatusForbidden, errors.New("only admins can clear the query cache"))
+			return
+		}
+
+		if clearCache, _ := t["clear"].(bool); clearCache {
+			ClearQueryCache()
+		}
+		json.NewEncoder(w).Encode(GetQueryCacheStats())
+	default:
+		log.Printf(Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}
@@ -0,0 +1,102 @@
+package Query
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNormaliseFlux(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"from(bucket: \"lcn\")\n  |> range(start: -1h)", `from(bucket: "lcn") |> range(start: -1h)`},
+		{`filter(fn: (r) => r["name"] == "a  b")`, `filter(fn: (r) => r["name"] == "a  b")`},
+		{"range(start: 2024-01-01T00:00:05Z,\n\tstop: 2024-01-01T00:00:25.5Z)", "range(start: 2024-01-01T00:00:05Z, stop: 2024-01-01T00:00:25.5Z)"},
+	}
+	for _, test := range tests {
+		if got := normaliseFlux(test.query); got != test.want {
+			t.Errorf("normaliseFlux(%q): got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestCachedQueryAbsoluteRanges(t *testing.T) {
+	t.Setenv("QUERY_CACHE_TTL", "3600")
+	ClearQueryCache()
+	t.Cleanup(ClearQueryCache)
+
+	runs := 0
+	run := func(Query string) interface{} {
+		value, err := cachedQuery("test", "token", Query, func() (interface{}, error) {
+			runs++
+			return Query, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	//absolute ranges inside one bucket keep their own results
+	first := "range(start: 2024-01-01T00:00:05Z, stop: 2024-01-01T00:00:10Z)"
+	second := "range(start: 2024-01-01T00:00:15Z, stop: 2024-01-01T00:00:20Z)"
+	if got := run(first); got != first {
+		t.Errorf("got %v, want %s", got, first)
+	}
+	if got := run(second); got != second {
+		t.Errorf("got %v, want %s", got, second)
+	}
+
+	//relative ranges and reformatted queries share the bucket
+	run("range(start: -1h)")
+	run("range(start:  -1h)\n")
+	if runs != 3 {
+		t.Errorf("got %d runs, want 3", runs)
+	}
+}
+
+func TestServerQueriesSkipCache(t *testing.T) {
+	body, err := os.ReadFile("testdata/multi.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(body)
+	}))
+	defer server.Close()
+	t.Setenv("API_URL", server.URL)
+	t.Setenv("QUERY_CACHE_TTL", "3600")
+	ClearQueryCache()
+	t.Cleanup(ClearQueryCache)
+
+	//jobs with a token always ask influxdb
+	for i := 0; i < 2; i++ {
+		if _, err := QueryInfluxDBWithToken("token", "range(start: -10m)"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := QueryTablesWithToken("token", "range(start: -10m)"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := requests.Load(); got != 4 {
+		t.Errorf("got %d requests for server queries, want 4", got)
+	}
+
+	//client queries share the cache
+	requests.Store(0)
+	for i := 0; i < 2; i++ {
+		if _, err := queryLineSets(context.Background(), "token", "range(start: -10m)"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests for client queries, want 1", got)
+	}
+}
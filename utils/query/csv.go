@@ -0,0 +1,244 @@
+package Query
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FluxColumn is one column of an annotated csv table
+type FluxColumn struct {
+	Name     string
+	DataType string
+	Group    bool
+	Default  string
+}
+
+// FluxRecord is one row of a table, values are typed by the column datatype
+type FluxRecord struct {
+	Result  string
+	Table   int
+	Columns []FluxColumn
+	Values  map[string]interface{}
+}
+
+// FluxReader decodes the annotated csv influxdb returns for flux queries
+// record by record, a response can hold several results and tables with
+// different columns
+type FluxReader struct {
+	csv           *csv.Reader
+	columns       []FluxColumn
+	annotations   map[string][]string
+	annotated     bool
+	inAnnotations bool
+	expectHeader  bool
+}
+
+func NewFluxReader(r io.Reader) *FluxReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = false
+	return &FluxReader{csv: reader}
+}
+
+func (f *FluxReader) Next() (FluxRecord, error) {
+	//next data row, io.EOF after the last one
+	for {
+		row, err := f.csv.Read()
+		if err == io.EOF {
+			return FluxRecord{}, io.EOF
+		}
+		if err != nil {
+			return FluxRecord{}, fmt.Errorf("fluxReader: %w", err)
+		}
+		if len(row) == 0 {
+			continue
+		}
+
+		//annotation rows start a new table block and come before its header
+		if strings.HasPrefix(row[0], "#") {
+			if !f.inAnnotations {
+				f.annotations = make(map[string][]string)
+				f.inAnnotations = true
+			}
+			f.annotations[row[0]] = row[1:]
+			f.annotated = true
+			f.expectHeader = true
+			continue
+		}
+		f.inAnnotations = false
+
+		if f.expectHeader || f.columns == nil || (!f.annotated && isFluxHeader(row)) {
+			f.setHeader(row[1:])
+			f.expectHeader = false
+
+			//errors during the query come back as a table of their own
+			if f.isErrorTable() {
+				return FluxRecord{}, f.readError()
+			}
+			continue
+		}
+
+		return f.record(row)
+	}
+}
+
+func isFluxHeader(row []string) bool {
+	//without annotations a new header only shows by its column names
+	return len(row) > 2 && row[1] == "result" && row[2] == "table"
+}
+
+func (f *FluxReader) setHeader(names []string) {
+	datatypes := f.annotations["#datatype"]
+	groups := f.annotations["#group"]
+	defaults := f.annotations["#default"]
+
+	f.columns = make([]FluxColumn, len(names))
+	for i, name := range names {
+		column := FluxColumn{Name: name}
+		if i < len(datatypes) {
+			column.DataType = datatypes[i]
+		} else {
+			column.DataType = inferFluxDataType(name)
+		}
+		if i < len(groups) {
+			column.Group = groups[i] == "true"
+		}
+		if i < len(defaults) {
+			column.Default = defaults[i]
+		}
+		f.columns[i] = column
+	}
+}
+
+func inferFluxDataType(name string) string {
+	//the columns every flux table has, everything else is guessed per value
+	switch name {
+	case "table":
+		return "long"
+	case "_start", "_stop", "_time":
+		return "dateTime:RFC3339"
+	case "_value":
+		return ""
+	}
+	return "string"
+}
+
+func (f *FluxReader) isErrorTable() bool {
+	hasError, hasTable := false, false
+	for _, column := range f.columns {
+		switch column.Name {
+		case "error":
+			hasError = true
+		case "table":
+			hasTable = true
+		}
+	}
+	return hasError && !hasTable
+}
+
+func (f *FluxReader) readError() error {
+	row, err := f.csv.Read()
+	if err != nil {
+		return errors.New("fluxReader: influxdb returned an error table")
+	}
+	for i, column := range f.columns {
+		if column.Name == "error" && i+1 < len(row) {
+			return fmt.Errorf("fluxReader: influxdb: %s", row[i+1])
+		}
+	}
+	return errors.New("fluxReader: influxdb returned an error table")
+}
+
+func (f *FluxReader) record(row []string) (FluxRecord, error) {
+	record := FluxRecord{Columns: f.columns, Values: make(map[string]interface{}, len(f.columns))}
+	for i, column := range f.columns {
+		raw := ""
+		if i+1 < len(row) {
+			raw = row[i+1]
+		}
+		if raw == "" {
+			raw = column.Default
+		}
+		if raw == "" {
+			record.Values[column.Name] = nil
+			continue
+		}
+
+		value, err := ParseFluxValue(column.DataType, raw)
+		if err != nil {
+			return FluxRecord{}, fmt.Errorf("fluxReader: column %s: %s", column.Name, err)
+		}
+		record.Values[column.Name] = value
+	}
+
+	record.Result, _ = record.Values["result"].(string)
+	if table, ok := record.Values["table"].(int64); ok {
+		record.Table = int(table)
+	}
+	return record, nil
+}
+
+func ParseFluxValue(dataType string, raw string) (interface{}, error) {
+	//typed value of a csv field, an unknown datatype is a number if possible
+	switch dataType {
+	case "string", "tag":
+		return raw, nil
+	case "long":
+		return strconv.ParseInt(raw, 10, 64)
+	case "unsignedLong":
+		return strconv.ParseUint(raw, 10, 64)
+	case "double":
+		return strconv.ParseFloat(raw, 64)
+	case "boolean":
+		return strconv.ParseBool(raw)
+	case "dateTime", "dateTime:RFC3339", "dateTime:RFC3339Nano":
+		return time.Parse(time.RFC3339Nano, raw)
+	case "duration":
+		return time.ParseDuration(raw)
+	case "base64Binary":
+		return base64.StdEncoding.DecodeString(raw)
+	case "":
+		if value, err := strconv.ParseFloat(raw, 64); err == nil {
+			return value, nil
+		}
+		return raw, nil
+	}
+	return nil, fmt.Errorf("unknown datatype %s", dataType)
+}
+
+func (r FluxRecord) Name() string {
+	//series name of the record, the lcn name tag or the field
+	for _, key := range []string{"name", "_field", "_measurement"} {
+		if name, ok := r.Values[key].(string); ok && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+func (r FluxRecord) Float(key string) (float64, bool) {
+	//numeric value of a column, booleans are 0 or 1
+	switch value := r.Values[key].(type) {
+	case float64:
+		return value, true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		number, err := strconv.ParseFloat(value, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,244 @@
+package Query
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+)
+
+func openFixture(t *testing.T, name string) *os.File {
+	t.Helper()
+
+	file, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func readFixture(t *testing.T, name string) ([]FluxRecord, error) {
+	//all records of a fixture up to the first error
+	t.Helper()
+
+	reader := NewFluxReader(openFixture(t, name))
+	records := make([]FluxRecord, 0)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func fixtureTime(t *testing.T, raw string) time.Time {
+	t.Helper()
+
+	value, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestFluxReaderMultipleResults(t *testing.T) {
+	records, err := readFixture(t, "multi.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %d records, want 4", len(records))
+	}
+
+	tests := []struct {
+		result string
+		table  int
+		name   string
+		time   string
+		value  interface{}
+	}{
+		{"_result", 0, "Wohnzimmer", "2024-01-01T00:10:00Z", 21.5},
+		{"_result", 0, "Wohnzimmer", "2024-01-01T00:20:00Z", 21.75},
+		{"_result", 1, "Bad", "2024-01-01T00:10:00Z", float64(19)},
+		{"counts", 0, "switches", "2024-01-01T00:30:00Z", int64(7)},
+	}
+	for i, test := range tests {
+		record := records[i]
+		if record.Result != test.result || record.Table != test.table {
+			t.Errorf("record %d: got %s:%d, want %s:%d", i, record.Result, record.Table, test.result, test.table)
+		}
+		if record.Name() != test.name {
+			t.Errorf("record %d: got name %s, want %s", i, record.Name(), test.name)
+		}
+		if got := record.Values["_time"]; got != fixtureTime(t, test.time) {
+			t.Errorf("record %d: got _time %v, want %s", i, got, test.time)
+		}
+		if got := record.Values["_value"]; got != test.value {
+			t.Errorf("record %d: got _value %#v, want %#v", i, got, test.value)
+		}
+	}
+
+	//the second result brings its own columns
+	if got := records[3].Values["ok"]; got != true {
+		t.Errorf("got ok %#v, want true", got)
+	}
+	if _, ok := records[3].Values["_measurement"]; ok {
+		t.Error("columns of the first result leaked into the second")
+	}
+	start := records[0].Columns[2]
+	if start.Name != "_start" || start.DataType != "dateTime:RFC3339" || !start.Group {
+		t.Errorf("got column %+v", start)
+	}
+}
+
+func TestFluxReaderQuotedFields(t *testing.T) {
+	records, err := readFixture(t, "quoted.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+
+	//line breaks inside quotes come back as \n like encoding/csv reads them
+	want := []string{"Fenster offen, Küche", "erste Zeile\nzweite Zeile \"zitiert\""}
+	for i, record := range records {
+		value := record.Values["_value"]
+		if value != want[i] {
+			t.Errorf("record %d: got _value %q, want %q", i, value, want[i])
+		}
+		if record.Name() != "Küche, Fenster" {
+			t.Errorf("record %d: got name %q", i, record.Name())
+		}
+	}
+}
+
+func TestFluxReaderDefaults(t *testing.T) {
+	records, err := readFixture(t, "default.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+
+	first, second := records[0], records[1]
+	if first.Result != "_result" || first.Table != 0 {
+		t.Errorf("got %s:%d, want _result:0", first.Result, first.Table)
+	}
+	if got := first.Values["table"]; got != int64(0) {
+		t.Errorf("got table %#v, want int64 0", got)
+	}
+	if got := first.Values["_field"]; got != "value" {
+		t.Errorf("got _field %#v, want value", got)
+	}
+	if first.Name() != "Flur" || second.Name() != "Keller" {
+		t.Errorf("got names %s and %s, want Flur and Keller", first.Name(), second.Name())
+	}
+	if got, ok := second.Values["_value"]; !ok || got != nil {
+		t.Errorf("got _value %#v, want nil", got)
+	}
+	if _, ok := second.Float("_value"); ok {
+		t.Error("an empty value is not a number")
+	}
+}
+
+func TestFluxReaderEmptyResult(t *testing.T) {
+	records, err := readFixture(t, "empty.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("got %d records, want 0", len(records))
+	}
+
+	resp, err := ProcessInfluxdbResponse(openFixture(t, "empty.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Amount != 0 || resp.LineSets == nil || resp.Names == nil {
+		t.Errorf("got %+v, want an empty response", resp)
+	}
+}
+
+func TestFluxReaderErrorTable(t *testing.T) {
+	_, err := readFixture(t, "error.csv")
+	if err == nil {
+		t.Fatal("no error for an error table")
+	}
+	if !strings.Contains(err.Error(), `failed to execute query: bucket "lcn" not found`) {
+		t.Errorf("got %s", err)
+	}
+
+	_, err = ProcessInfluxdbResponse(openFixture(t, "error.csv"))
+	if err == nil {
+		t.Error("ProcessInfluxdbResponse hid the error table")
+	}
+}
+
+func TestParseFluxValue(t *testing.T) {
+	tests := []struct {
+		dataType string
+		raw      string
+		want     interface{}
+	}{
+		{"string", "21.5", "21.5"},
+		{"long", "-3", int64(-3)},
+		{"unsignedLong", "3", uint64(3)},
+		{"double", "21.5", 21.5},
+		{"boolean", "false", false},
+		{"dateTime:RFC3339", "2024-01-01T00:00:00Z", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"dateTime:RFC3339Nano", "2024-01-01T00:00:00.5Z", time.Date(2024, 1, 1, 0, 0, 0, 500000000, time.UTC)},
+		{"duration", "1h30m", 90 * time.Minute},
+		{"base64Binary", "aGFsbG8=", []byte("hallo")},
+		{"", "4", float64(4)},
+		{"", "an", "an"},
+	}
+	for _, test := range tests {
+		got, err := ParseFluxValue(test.dataType, test.raw)
+		if err != nil {
+			t.Errorf("%s %s: %s", test.dataType, test.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %s: got %#v, want %#v", test.dataType, test.raw, got, test.want)
+		}
+	}
+
+	for _, dataType := range []string{"long", "double", "boolean", "dateTime:RFC3339", "unknown"} {
+		if _, err := ParseFluxValue(dataType, "x"); err == nil {
+			t.Errorf("%s x: no error", dataType)
+		}
+	}
+}
+
+func TestProcessInfluxdbResponse(t *testing.T) {
+	resp, err := ProcessInfluxdbResponse(openFixture(t, "multi.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//one line set per table of every result
+	want := QueryResponse{
+		LineSets: [][]Pair{
+			{{Title: "2024-01-01T00:10:00Z", Value: 21.5}, {Title: "2024-01-01T00:20:00Z", Value: 21.75}},
+			{{Title: "2024-01-01T00:10:00Z", Value: 19}},
+			{{Title: "2024-01-01T00:30:00Z", Value: 7}},
+		},
+		Names:  []string{"Wohnzimmer", "Bad", "switches"},
+		Amount: 3,
+	}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("got %+v, want %+v", resp, want)
+	}
+}
@@ -0,0 +1,227 @@
+package Query
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+)
+
+// flux duration units in nanoseconds, months and years are approximated
+var fluxUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"mo": 30 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+func maxPoints() int {
+	//upper bound for the points a client may ask for
+	points, err := strconv.Atoi(os.Getenv("QUERY_MAX_POINTS"))
+	if err != nil || points <= 0 {
+		return 5000
+	}
+	return points
+}
+
+func TargetPoints(t map[string]interface{}) int {
+	//points or pixel width from a request, one point per pixel, 0 keeps all
+	points, _ := t["points"].(float64)
+	if width, ok := t["width"].(float64); ok && points == 0 {
+		points = width
+	}
+	if points <= 0 {
+		return 0
+	}
+	return int(math.Min(points, float64(maxPoints())))
+}
+
+func parseFluxDuration(value string) (time.Duration, error) {
+	//a flux duration literal like -7d or 1h30m as a go duration
+	if !fluxDuration.MatchString(value) {
+		return 0, fmt.Errorf("%w: %s is no duration", ErrSeriesQuery, value)
+	}
+	sign := time.Duration(1)
+	if value[0] == '-' {
+		sign = -1
+		value = value[1:]
+	}
+
+	var duration time.Duration
+	for value != "" {
+		i := 0
+		for i < len(value) && value[i] >= '0' && value[i] <= '9' {
+			i++
+		}
+		amount, _ := strconv.Atoi(value[:i])
+		j := i
+		for j < len(value) && (value[j] < '0' || value[j] > '9') {
+			j++
+		}
+		duration += time.Duration(amount) * fluxUnits[value[i:j]]
+		value = value[j:]
+	}
+	return sign * duration, nil
+}
+
+func resolveFluxTime(value string, now time.Time) (time.Time, error) {
+	//absolute time of a start or stop value, relative ones count from now
+	if value == "" || value == "now()" {
+		return now, nil
+	}
+	if duration, err := parseFluxDuration(value); err == nil {
+		return now.Add(duration), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func seriesWindow(seriesQuery SeriesQuery) (string, error) {
+	//the aggregate window that splits the range into at most Points windows
+	now := time.Now()
+	if seriesQuery.Start == "" {
+		seriesQuery.Start = "-1h"
+	}
+	start, err := resolveFluxTime(seriesQuery.Start, now)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrSeriesQuery, err)
+	}
+	stop, err := resolveFluxTime(seriesQuery.Stop, now)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrSeriesQuery, err)
+	}
+	if !stop.After(start) {
+		return "", fmt.Errorf("%w: start is not before stop", ErrSeriesQuery)
+	}
+
+	seconds := int(math.Ceil(stop.Sub(start).Seconds() / float64(seriesQuery.Points)))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds) + "s", nil
+}
+
+func DownsampleResponse(resp QueryResponse, points int) QueryResponse {
+	//largest triangle three buckets on every line set, the line sets are
+	//copied since resp may be shared with the cache
+	lineSets := make([][]Pair, len(resp.LineSets))
+	for i, lineSet := range resp.LineSets {
+		x := make([]float64, len(lineSet))
+		y := make([]float64, len(lineSet))
+		for j, pair := range lineSet {
+			x[j] = pairX(pair.Title, j)
+			y[j] = pair.Value
+		}
+
+		keep := LTTB(x, y, points)
+		downsampled := make([]Pair, 0, len(keep))
+		for _, j := range keep {
+			downsampled = append(downsampled, lineSet[j])
+		}
+		lineSets[i] = downsampled
+	}
+	resp.LineSets = lineSets
+	return resp
+}
+
+func DownsampleTables(resp QueryTablesResponse, points int) QueryTablesResponse {
+	//tables are downsampled by their first numeric field, the other fields
+	//of a kept row stay with it
+	tables := make([]QueryTable, len(resp.Tables))
+	for i, table := range resp.Tables {
+		x := make([]float64, len(table.Rows))
+		y := make([]float64, len(table.Rows))
+		for j, row := range table.Rows {
+			x[j] = float64(j)
+			if row.Time != nil {
+				x[j] = float64(row.Time.UnixNano())
+			}
+			for _, field := range table.Fields {
+				if value, ok := (FluxRecord{Values: row.Fields}).Float(field); ok {
+					y[j] = value
+					break
+				}
+			}
+		}
+
+		keep := LTTB(x, y, points)
+		rows := make([]QueryRow, 0, len(keep))
+		for _, j := range keep {
+			rows = append(rows, table.Rows[j])
+		}
+		tables[i] = table
+		tables[i].Rows = rows
+	}
+	resp.Tables = tables
+	return resp
+}
+
+func pairX(title string, i int) float64 {
+	//timestamps of a line set, the index if the title is no time
+	t, err := time.Parse(time.RFC3339Nano, title)
+	if err != nil {
+		return float64(i)
+	}
+	return float64(t.UnixNano())
+}
+
+func LTTB(x []float64, y []float64, threshold int) []int {
+	//indexes of the points largest triangle three buckets keeps, first and
+	//last point are always kept
+	if threshold >= len(x) || threshold <= 0 {
+		keep := make([]int, len(x))
+		for i := range x {
+			keep[i] = i
+		}
+		return keep
+	}
+	if threshold < 3 {
+		return []int{0, len(x) - 1}
+	}
+
+	keep := make([]int, 0, threshold)
+	keep = append(keep, 0)
+	bucketSize := float64(len(x)-2) / float64(threshold-2)
+	a := 0
+	for bucket := 0; bucket < threshold-2; bucket++ {
+		//average of the next bucket is the third triangle point
+		nextStart := int(math.Floor(float64(bucket+1)*bucketSize)) + 1
+		nextEnd := int(math.Floor(float64(bucket+2)*bucketSize)) + 1
+		if nextEnd > len(x) {
+			nextEnd = len(x)
+		}
+		avgX, avgY := 0.0, 0.0
+		for i := nextStart; i < nextEnd; i++ {
+			avgX += x[i]
+			avgY += y[i]
+		}
+		if count := float64(nextEnd - nextStart); count > 0 {
+			avgX /= count
+			avgY /= count
+		} else {
+			avgX, avgY = x[len(x)-1], y[len(y)-1]
+		}
+
+		//point of the current bucket with the largest triangle
+		start := int(math.Floor(float64(bucket)*bucketSize)) + 1
+		end := nextStart
+		maxArea, maxI := -1.0, start
+		for i := start; i < end; i++ {
+			area := math.Abs((x[a]-avgX)*(y[i]-y[a]) - (x[a]-x[i])*(avgY-y[a]))
+			if area > maxArea {
+				maxArea, maxI = area, i
+			}
+		}
+		keep = append(keep, maxI)
+		a = maxI
+	}
+	return append(keep, len(x)-1)
+}
@@ -0,0 +1,404 @@
+package Query
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+var ExportCSV = "csv"
+var ExportNDJSON = "ndjson"
+var ExportXLSX = "xlsx"
+
+// the columns csv and xlsx exports have without a column selection
+var defaultExportColumns = []string{"_time", "name", "_field", "_value"}
+
+// exports are written row by row while influxdb is still sending, nothing
+// buffers the whole result
+type exportWriter interface {
+	WriteRecord(record FluxRecord) error
+	Close() error
+}
+
+func exportValue(value interface{}, location *time.Location) interface{} {
+	//times in the requested zone, the rest as in the typed tables
+	if t, ok := value.(time.Time); ok {
+		return t.In(location).Format(time.RFC3339Nano)
+	}
+	return jsonFluxValue(value)
+}
+
+func exportString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+type csvExport struct {
+	writer  *csv.Writer
+	columns []string
+	loc     *time.Location
+}
+
+func newCSVExport(w io.Writer, columns []string, location *time.Location) (*csvExport, error) {
+	writer := csv.NewWriter(w)
+	err := writer.Write(columns)
+	return &csvExport{writer: writer, columns: columns, loc: location}, err
+}
+
+func (e *csvExport) WriteRecord(record FluxRecord) error {
+	row := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		row[i] = exportString(exportValue(record.Values[column], e.loc))
+	}
+	return e.writer.Write(row)
+}
+
+func (e *csvExport) Close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type ndjsonExport struct {
+	encoder *json.Encoder
+	columns []string
+	loc     *time.Location
+}
+
+func (e *ndjsonExport) WriteRecord(record FluxRecord) error {
+	//every column of the record unless columns were selected
+	line := make(map[string]interface{})
+	if len(e.columns) == 0 {
+		for _, column := range record.Columns {
+			if column.Name == "result" || column.Name == "table" {
+				continue
+			}
+			line[column.Name] = exportValue(record.Values[column.Name], e.loc)
+		}
+	} else {
+		for _, column := range e.columns {
+			line[column] = exportValue(record.Values[column], e.loc)
+		}
+	}
+	return e.encoder.Encode(line)
+}
+
+func (e *ndjsonExport) Close() error {
+	return nil
+}
+
+// a minimal workbook with one sheet, cells are inline strings so no shared
+// string table has to be collected before the sheet is written
+var xlsxFiles = map[string]string{
+	"[Content_Types].xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`,
+	"_rels/.rels": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`,
+	"xl/workbook.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="export" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`,
+	"xl/_rels/workbook.xml.rels": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`,
+}
+var xlsxOrder = []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels"}
+
+type xlsxExport struct {
+	zip     *zip.Writer
+	sheet   *bufio.Writer
+	columns []string
+	loc     *time.Location
+	row     int
+}
+
+func newXLSXExport(w io.Writer, columns []string, location *time.Location) (*xlsxExport, error) {
+	archive := zip.NewWriter(w)
+	for _, name := range xlsxOrder {
+		file, err := archive.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(file, xlsxFiles[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	//the sheet is the last file, rows go straight into the archive
+	sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	e := &xlsxExport{zip: archive, sheet: bufio.NewWriter(sheet), columns: columns, loc: location}
+	e.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	return e, e.writeRow(header)
+}
+
+func xlsxColumn(i int) string {
+	//A, B, ... Z, AA, AB, ...
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func xlsxEscape(value string) string {
+	var builder strings.Builder
+	for _, c := range value {
+		switch c {
+		case '&':
+			builder.WriteString("&amp;")
+		case '<':
+			builder.WriteString("&lt;")
+		case '>':
+			builder.WriteString("&gt;")
+		case '"':
+			builder.WriteString("&quot;")
+		default:
+			//control characters are not allowed in xml
+			if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+				continue
+			}
+			builder.WriteRune(c)
+		}
+	}
+	return builder.String()
+}
+
+func (e *xlsxExport) writeRow(values []interface{}) error {
+	e.row++
+	fmt.Fprintf(e.sheet, `<row r="%d">`, e.row)
+	for i, value := range values {
+		ref := xlsxColumn(i) + strconv.Itoa(e.row)
+		switch v := value.(type) {
+		case nil:
+			continue
+		case float64, int64, uint64:
+			fmt.Fprintf(e.sheet, `<c r="%s"><v>%v</v></c>`, ref, v)
+		case bool:
+			cell := 0
+			if v {
+				cell = 1
+			}
+			fmt.Fprintf(e.sheet, `<c r="%s" t="b"><v>%d</v></c>`, ref, cell)
+		default:
+			fmt.Fprintf(e.sheet, `<c r="%s" t="inlineStr"><is><t>%s</t></is></c>`, ref, xlsxEscape(fmt.Sprint(v)))
+		}
+	}
+	_, err := e.sheet.WriteString("</row>")
+	return err
+}
+
+func (e *xlsxExport) WriteRecord(record FluxRecord) error {
+	row := make([]interface{}, len(e.columns))
+	for i, column := range e.columns {
+		row[i] = exportValue(record.Values[column], e.loc)
+	}
+	return e.writeRow(row)
+}
+
+func (e *xlsxExport) Close() error {
+	e.sheet.WriteString("</sheetData></worksheet>")
+	if err := e.sheet.Flush(); err != nil {
+		return err
+	}
+	return e.zip.Close()
+}
+
+func Export(w http.ResponseWriter, r *http.Request) {
+	//download the result of a flux or series query as csv, ndjson or xlsx
+	switch r.Method {
+	case "POST":
+		w.Header().Set("Content-Type", "application/json")
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//check if session token is valid
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			SendError(w, http.StatusUnauthorized, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//a series query or raw flux where that is allowed
+		queryStr, _ := t["query"].(string)
+		if _, ok := t["series"]; ok {
+			seriesQuery := SeriesQueryFromRequest(t)
+			err = CheckSeriesAllowed(seriesQuery.Series)
+			if err != nil {
+				SendError(w, http.StatusForbidden, err)
+				return
+			}
+			queryStr, err = BuildSeriesQuery(seriesQuery)
+			if err != nil {
+				SendError(w, http.StatusBadRequest, err)
+				return
+			}
+		} else {
+			is_allowed, err := RawQueryAllowed(session_token)
+			if err != nil {
+				SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking admin: %s", err))
+				return
+			}
+			if !is_allowed {
+				SendError(w, http.StatusForbidden, errors.New("raw flux queries are only allowed for admins"))
+				return
+			}
+		}
+		if queryStr == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no query"))
+			return
+		}
+
+		format, _ := t["format"].(string)
+		if format == "" {
+			format = ExportCSV
+		}
+		if format != ExportCSV && format != ExportNDJSON && format != ExportXLSX {
+			SendError(w, http.StatusBadRequest, fmt.Errorf("unknown format %s", format))
+			return
+		}
+
+		tz, _ := t["tz"].(string)
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			SendError(w, http.StatusBadRequest, fmt.Errorf("unknown time zone %s", tz))
+			return
+		}
+
+		columns := make([]string, 0)
+		rawColumns, _ := t["columns"].([]interface{})
+		for _, rawColumn := range rawColumns {
+			if column, ok := rawColumn.(string); ok && column != "" {
+				columns = append(columns, column)
+			}
+		}
+		if len(columns) == 0 && format != ExportNDJSON {
+			columns = defaultExportColumns
+		}
+
+		influx_token, err := GetInfluxTokenFromSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting influx token: %s", err))
+			return
+		}
+		//exports stream, so only the longer export timeout limits them
+		resp, err := openInfluxQuery(r.Context(), exportTimeout(), influx_token, queryStr)
+		if err != nil {
+			SendQueryError(w, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		//errors in front of the first row still get a json answer
+		reader := NewFluxReader(resp.Body)
+		record, err := reader.Next()
+		if err != nil && err != io.EOF {
+			SendQueryError(w, err)
+			return
+		}
+
+		err = writeExport(w, format, columns, location, record, err == io.EOF, reader)
+		if err != nil {
+			log.Printf(Red+"error exporting query: %s\n"+Reset, err)
+		}
+	default:
+		log.Printf(Red + "Sorry, only POST method is supported.\n" + r.Method + Reset)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only POST method is supported."})
+	}
+}
+
+func writeExport(w http.ResponseWriter, format string, columns []string, location *time.Location, first FluxRecord, empty bool, reader *FluxReader) error {
+	//stream every record into the export, flushing to the client as it goes
+	filename := "export-" + time.Now().In(location).Format("20060102-150405") + "." + format
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	var export exportWriter
+	var err error
+	switch format {
+	case ExportCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		export, err = newCSVExport(w, columns, location)
+	case ExportNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		export = &ndjsonExport{encoder: json.NewEncoder(w), columns: columns, loc: location}
+	case ExportXLSX:
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		export, err = newXLSXExport(w, columns, location)
+	}
+	if err != nil {
+		return err
+	}
+
+	flusher, _ := w.(http.Flusher)
+	record := first
+	for rows := 0; !empty; rows++ {
+		if err := export.WriteRecord(record); err != nil {
+			return err
+		}
+		if flusher != nil && rows%1000 == 999 {
+			if csvWriter, ok := export.(*csvExport); ok {
+				csvWriter.writer.Flush()
+			}
+			flusher.Flush()
+		}
+
+		record, err = reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//closing would finish a valid looking file without the missing rows,
+			//so the connection is dropped and the download fails
+			log.Printf(Red+"error exporting query: %s\n"+Reset, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return export.Close()
+}
@@ -0,0 +1,36 @@
+package Query
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the second row breaks the long column so the export fails after the first
+const brokenExport = "#datatype,string,long,dateTime:RFC3339,double,string\r\n" +
+	"#group,false,false,false,false,true\r\n" +
+	"#default,_result,,,,\r\n" +
+	",result,table,_time,_value,name\r\n" +
+	",,0,2024-01-01T00:10:00Z,21.5,Wohnzimmer\r\n" +
+	",,x,2024-01-01T00:20:00Z,21.75,Wohnzimmer\r\n"
+
+func TestWriteExportAbortsOnReadError(t *testing.T) {
+	for _, format := range []string{ExportCSV, ExportNDJSON, ExportXLSX} {
+		t.Run(format, func(t *testing.T) {
+			reader := NewFluxReader(strings.NewReader(brokenExport))
+			first, err := reader.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				if got := recover(); got != http.ErrAbortHandler {
+					t.Errorf("got %v, want the handler to abort", got)
+				}
+			}()
+			writeExport(httptest.NewRecorder(), format, defaultExportColumns, time.UTC, first, false, reader)
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package Query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+var ErrQueryTimeout = errors.New("query timed out")
+var ErrQueryTooLarge = errors.New("query result too large")
+
+// the deadline of a query comes from its context, so the client itself has
+// no timeout that would cut long exports short
+var influxClient = &http.Client{}
+
+func queryTimeout() time.Duration {
+	//QUERY_TIMEOUT in seconds for queries answered in one piece
+	timeout, err := strconv.Atoi(os.Getenv("QUERY_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+func exportTimeout() time.Duration {
+	//QUERY_EXPORT_TIMEOUT in seconds, exports stream and may take longer
+	timeout, err := strconv.Atoi(os.Getenv("QUERY_EXPORT_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+func maxQueryBytes() int64 {
+	//QUERY_MAX_BYTES of annotated csv read for one query, 0 turns it off
+	size, err := strconv.ParseInt(os.Getenv("QUERY_MAX_BYTES"), 10, 64)
+	if err != nil || size < 0 {
+		return 64 << 20
+	}
+	return size
+}
+
+func maxQueryRows() int {
+	//QUERY_MAX_ROWS read for one query, 0 turns it off
+	rows, err := strconv.Atoi(os.Getenv("QUERY_MAX_ROWS"))
+	if err != nil || rows < 0 {
+		return 200000
+	}
+	return rows
+}
+
+// queryBody cancels the context of its query when it is closed and turns an
+// expired deadline into ErrQueryTimeout
+type queryBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+func (b *queryBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = queryContextError(b.ctx, b.timeout, err)
+	}
+	return n, err
+}
+
+func (b *queryBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func queryContextError(ctx context.Context, timeout time.Duration, err error) error {
+	//errors of an ended context say why it ended
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w after %s", ErrQueryTimeout, timeout)
+	case context.Canceled:
+		return context.Canceled
+	}
+	return err
+}
+
+// limitedBody stops reading once more than limit bytes came in
+type limitedBody struct {
+	reader io.Reader
+	read   int64
+	limit  int64
+}
+
+func limitQueryBody(body io.Reader) io.Reader {
+	limit := maxQueryBytes()
+	if limit == 0 {
+		return body
+	}
+	return &limitedBody{reader: body, limit: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	//read one byte past the limit to tell a full body from a cut one
+	if b.read > b.limit {
+		return 0, fmt.Errorf("%w: more than %d bytes, narrow the range or use a window", ErrQueryTooLarge, b.limit)
+	}
+	if int64(len(p)) > b.limit-b.read+1 {
+		p = p[:b.limit-b.read+1]
+	}
+	n, err := b.reader.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return 0, fmt.Errorf("%w: more than %d bytes, narrow the range or use a window", ErrQueryTooLarge, b.limit)
+	}
+	return n, err
+}
+
+// rowLimit counts the records of one query against QUERY_MAX_ROWS
+type rowLimit struct {
+	rows  int
+	limit int
+}
+
+func newRowLimit() *rowLimit {
+	return &rowLimit{limit: maxQueryRows()}
+}
+
+func (l *rowLimit) add() error {
+	//called once per record read
+	l.rows++
+	if l.limit > 0 && l.rows > l.limit {
+		return fmt.Errorf("%w: more than %d rows, narrow the range or use a window", ErrQueryTooLarge, l.limit)
+	}
+	return nil
+}
+
+func SendQueryError(w http.ResponseWriter, err error) {
+	//answer a failed query with the status that fits its cause
+	switch {
+	case errors.Is(err, context.Canceled):
+		//the client is gone, nobody reads the answer
+		return
+	case errors.Is(err, ErrQueryTimeout):
+		SendError(w, http.StatusGatewayTimeout, err)
+	case errors.Is(err, ErrQueryTooLarge):
+		//the request is fine, its result is what can not be processed
+		SendError(w, http.StatusUnprocessableEntity, err)
+	default:
+		SendError(w, http.StatusInternalServerError, fmt.Errorf("error querying influxdb: %s", err))
+	}
+}
@@ -0,0 +1,95 @@
+package Query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQueryRowLimit(t *testing.T) {
+	t.Setenv("QUERY_MAX_ROWS", "2")
+
+	_, err := ProcessInfluxdbResponse(openFixture(t, "multi.csv"))
+	if !errors.Is(err, ErrQueryTooLarge) {
+		t.Errorf("lineSets: got %v, want %s", err, ErrQueryTooLarge)
+	}
+	_, err = ProcessInfluxdbTables(openFixture(t, "multi.csv"))
+	if !errors.Is(err, ErrQueryTooLarge) {
+		t.Errorf("tables: got %v, want %s", err, ErrQueryTooLarge)
+	}
+
+	t.Setenv("QUERY_MAX_ROWS", "4")
+	_, err = ProcessInfluxdbResponse(openFixture(t, "multi.csv"))
+	if err != nil {
+		t.Errorf("got %s for a result at the limit", err)
+	}
+}
+
+func TestQueryByteLimit(t *testing.T) {
+	info, err := os.Stat("testdata/multi.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("QUERY_MAX_BYTES", fmt.Sprint(info.Size()-1))
+	_, err = ProcessInfluxdbResponse(limitQueryBody(openFixture(t, "multi.csv")))
+	if !errors.Is(err, ErrQueryTooLarge) {
+		t.Errorf("got %v, want %s", err, ErrQueryTooLarge)
+	}
+
+	t.Setenv("QUERY_MAX_BYTES", fmt.Sprint(info.Size()))
+	_, err = ProcessInfluxdbResponse(limitQueryBody(openFixture(t, "multi.csv")))
+	if err != nil {
+		t.Errorf("got %s for a body at the limit", err)
+	}
+}
+
+func TestQueryTimeoutAndCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	t.Setenv("API_URL", server.URL)
+	t.Setenv("QUERY_CACHE_TTL", "0")
+	t.Setenv("QUERY_TIMEOUT", "1")
+
+	_, err := queryLineSets(context.Background(), "token", "timeout")
+	if !errors.Is(err, ErrQueryTimeout) {
+		t.Errorf("got %v, want %s", err, ErrQueryTimeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = queryLineSets(ctx, "token", "cancel")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %s", err, context.Canceled)
+	}
+}
+
+func TestSendQueryError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{fmt.Errorf("QueryInfluxDB: %w", ErrQueryTimeout), http.StatusGatewayTimeout},
+		{fmt.Errorf("QueryInfluxDB: %w", ErrQueryTooLarge), http.StatusUnprocessableEntity},
+		{errors.New("influxdb is down"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		SendQueryError(w, test.err)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d, want %d", test.err, w.Code, test.code)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package Query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+// one poller asks influxdb for the series of all live clients and fans new
+// points out to the clients that subscribed to them, every influxdb token is
+// polled with its own rights so clients only see what their account may read
+type liveSubscriber struct {
+	ch     chan QueryLivePoint
+	token  string
+	series map[string]bool
+}
+
+var liveSubscribers = make(map[*liveSubscriber]bool)
+var liveLastSeen = make(map[string]time.Time)
+var liveLatest = make(map[string]QueryLivePoint)
+var livePolling = false
+var liveMu sync.Mutex
+
+// a series seen for the first time only sends its latest point from this far back
+var liveLookback = 1 * time.Hour
+
+func liveInterval() time.Duration {
+	interval, err := strconv.Atoi(os.Getenv("QUERY_LIVE_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(interval) * time.Second
+}
+
+func liveKey(influx_token string, name string) string {
+	return influx_token + "\x00" + name
+}
+
+func subscribeLive(influx_token string, series []string) *liveSubscriber {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+
+	subscriber := &liveSubscriber{ch: make(chan QueryLivePoint, 64), token: influx_token, series: make(map[string]bool)}
+	for _, name := range series {
+		subscriber.series[name] = true
+	}
+	liveSubscribers[subscriber] = true
+
+	//series other clients with the same token already watch start with their latest point
+	for _, name := range series {
+		if point, ok := liveLatest[liveKey(influx_token, name)]; ok {
+			select {
+			case subscriber.ch <- point:
+			default:
+			}
+		}
+	}
+
+	//the poller runs while there are subscribers
+	if !livePolling {
+		livePolling = true
+		go pollLive()
+	}
+	return subscriber
+}
+
+func unsubscribeLive(subscriber *liveSubscriber) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+
+	if liveSubscribers[subscriber] {
+		delete(liveSubscribers, subscriber)
+		close(subscriber.ch)
+	}
+}
+
+func liveSeries() map[string][]string {
+	//every series at least one subscriber wants per influxdb token, callers hold liveMu
+	seen := make(map[string]bool)
+	series := make(map[string][]string)
+	for subscriber := range liveSubscribers {
+		for name := range subscriber.series {
+			key := liveKey(subscriber.token, name)
+			if !seen[key] {
+				seen[key] = true
+				series[subscriber.token] = append(series[subscriber.token], name)
+			}
+		}
+	}
+	return series
+}
+
+func pollLive() {
+	for {
+		liveMu.Lock()
+		series := liveSeries()
+		if len(series) == 0 {
+			livePolling = false
+			liveLastSeen = make(map[string]time.Time)
+			liveLatest = make(map[string]QueryLivePoint)
+			liveMu.Unlock()
+			return
+		}
+
+		//series nobody watches anymore start fresh when they come back
+		watched := make(map[string]bool)
+		for influx_token, names := range series {
+			for _, name := range names {
+				watched[liveKey(influx_token, name)] = true
+			}
+		}
+		for key := range liveLastSeen {
+			if !watched[key] {
+				delete(liveLastSeen, key)
+				delete(liveLatest, key)
+			}
+		}
+
+		//start at the oldest point a series of the token has seen
+		start := time.Now().Add(-liveLookback)
+		oldest := make(map[string]time.Time)
+		for influx_token, names := range series {
+			for _, name := range names {
+				lastSeen, ok := liveLastSeen[liveKey(influx_token, name)]
+				if !ok {
+					oldest[influx_token] = start
+					break
+				}
+				if current, found := oldest[influx_token]; !found || lastSeen.Before(current) {
+					oldest[influx_token] = lastSeen
+				}
+			}
+			if oldest[influx_token].Before(start) {
+				oldest[influx_token] = start
+			}
+		}
+		liveMu.Unlock()
+
+		for influx_token, names := range series {
+			points, err := queryLivePoints(influx_token, names, oldest[influx_token])
+			if err != nil {
+				log.Printf(Red+"error polling live series: %s\n"+Reset, err)
+				continue
+			}
+			publishLivePoints(influx_token, points)
+		}
+		time.Sleep(liveInterval())
+	}
+}
+
+func queryLivePoints(influx_token string, series []string, start time.Time) ([]QueryLivePoint, error) {
+	//every point since start the token may read, oldest first per series
+	filters := make([]string, 0, len(series))
+	for _, name := range series {
+		filters = append(filters, fmt.Sprintf("r[\"name\"] == %s", FluxString(name)))
+	}
+	bucket := FluxString(seriesBucket())
+	queryStr := fmt.Sprintf("from(bucket: %s)\n"+
+		"|> range(start: %s)\n"+
+		"|> filter(fn: (r) => r[\"_measurement\"] == %s)\n"+
+		"|> filter(fn: (r) => %s)", bucket, start.UTC().Format(time.RFC3339Nano), bucket, strings.Join(filters, " or "))
+
+	//live points never come from the cache
+	resp, err := openInfluxQuery(context.Background(), queryTimeout(), influx_token, queryStr)
+	if err != nil {
+		return []QueryLivePoint{}, err
+	}
+	defer resp.Body.Close()
+
+	points := make([]QueryLivePoint, 0)
+	reader := NewFluxReader(limitQueryBody(resp.Body))
+	rows := newRowLimit()
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = rows.add()
+		}
+		if err != nil {
+			return []QueryLivePoint{}, err
+		}
+		t, ok := record.Values["_time"].(time.Time)
+		if !ok {
+			continue
+		}
+		field, _ := record.Values["_field"].(string)
+		points = append(points, QueryLivePoint{Name: record.Name(), Field: field, Time: t, Value: jsonFluxValue(record.Values["_value"])})
+	}
+	return points, nil
+}
+
+func publishLivePoints(influx_token string, points []QueryLivePoint) {
+	//send points newer than the last seen one to the subscribers of the token,
+	//a new series only sends its latest
+	liveMu.Lock()
+	defer liveMu.Unlock()
+
+	latest := make(map[string]QueryLivePoint)
+	fresh := make([]QueryLivePoint, 0)
+	for _, point := range points {
+		lastSeen, ok := liveLastSeen[liveKey(influx_token, point.Name)]
+		if !ok {
+			if current, found := latest[point.Name]; !found || point.Time.After(current.Time) {
+				latest[point.Name] = point
+			}
+			continue
+		}
+		if point.Time.After(lastSeen) {
+			fresh = append(fresh, point)
+		}
+	}
+	for _, point := range latest {
+		fresh = append(fresh, point)
+	}
+
+	for _, point := range fresh {
+		key := liveKey(influx_token, point.Name)
+		if point.Time.After(liveLastSeen[key]) {
+			liveLastSeen[key] = point.Time
+			liveLatest[key] = point
+		}
+		for subscriber := range liveSubscribers {
+			if subscriber.token != influx_token || !subscriber.series[point.Name] {
+				continue
+			}
+			select {
+			case subscriber.ch <- point:
+			default:
+				//slow clients are dropped and reconnect
+				delete(liveSubscribers, subscriber)
+				close(subscriber.ch)
+			}
+		}
+	}
+}
+
+func formatLiveEvent(event string, data any) (string, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("event: %s\ndata: %s\n\n", event, payload), nil
+}
+
+func Live(w http.ResponseWriter, r *http.Request) {
+	//stream new points of the series in ?series=a,b as server sent events
+	if r.Method != "GET" {
+		log.Printf(Red + "Sorry, only GET method is supported.\n" + r.Method + Reset)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET method is supported."})
+		return
+	}
+
+	//check if session token is valid
+	session_token := r.URL.Query().Get("session_token")
+	if session_token == "" {
+		http.Error(w, "no session token", http.StatusUnauthorized)
+		return
+	}
+	is_valid, err := CheckSession(session_token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error checking session: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !is_valid {
+		http.Error(w, "session token is invalid", http.StatusForbidden)
+		return
+	}
+
+	//points are polled with the influxdb token of the session, never an admin token
+	influx_token, err := GetInfluxTokenFromSession(session_token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting influx token: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	series := make([]string, 0)
+	for _, param := range r.URL.Query()["series"] {
+		for _, name := range strings.Split(param, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if !seriesAllowed(name) {
+				http.Error(w, fmt.Sprintf("%s: %s", ErrSeriesNotAllowed, name), http.StatusForbidden)
+				return
+			}
+			series = append(series, name)
+		}
+	}
+	if len(series) == 0 {
+		http.Error(w, "no series", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "SSE not supported", http.StatusInternalServerError)
+		return
+	}
+
+	subscriber := subscribeLive(influx_token, series)
+	defer unsubscribeLive(subscriber)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case point, ok := <-subscriber.ch:
+			if !ok {
+				return
+			}
+			event, err := formatLiveEvent("point", point)
+			if err != nil {
+				log.Printf(Red+"error formatting live point: %s\n"+Reset, err)
+				return
+			}
+			_, err = fmt.Fprint(w, event)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
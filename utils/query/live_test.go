@@ -0,0 +1,56 @@
+package Query
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+)
+
+func TestLivePointsStayWithTheirToken(t *testing.T) {
+	//no poller, points are published by hand
+	liveMu.Lock()
+	livePolling = true
+	liveMu.Unlock()
+	t.Cleanup(func() {
+		liveMu.Lock()
+		livePolling = false
+		liveSubscribers = make(map[*liveSubscriber]bool)
+		liveLastSeen = make(map[string]time.Time)
+		liveLatest = make(map[string]QueryLivePoint)
+		liveMu.Unlock()
+	})
+
+	first := subscribeLive("first", []string{"Wohnzimmer"})
+	second := subscribeLive("second", []string{"Wohnzimmer"})
+	if series := liveSeries(); len(series["first"]) != 1 || len(series["second"]) != 1 {
+		t.Fatalf("got series %v, want one per token", series)
+	}
+
+	point := QueryLivePoint{Name: "Wohnzimmer", Time: time.Now(), Value: 21.5}
+	publishLivePoints("first", []QueryLivePoint{point})
+	select {
+	case got := <-first.ch:
+		if got.Value != point.Value {
+			t.Errorf("got %v, want %v", got.Value, point.Value)
+		}
+	default:
+		t.Error("the subscriber of the token got no point")
+	}
+	select {
+	case got := <-second.ch:
+		t.Errorf("a point polled with another token leaked: %+v", got)
+	default:
+	}
+
+	//a late subscriber only starts with the latest point of its own token
+	late := subscribeLive("second", []string{"Wohnzimmer"})
+	select {
+	case got := <-late.ch:
+		t.Errorf("a point polled with another token leaked: %+v", got)
+	default:
+	}
+	unsubscribeLive(first)
+	unsubscribeLive(second)
+	unsubscribeLive(late)
+}
@@ -2,14 +2,16 @@ package Query
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
+	"time"
 
 	. "github.com/GineHyte/server/models"
 	. "github.com/GineHyte/server/utils/tools"
@@ -47,6 +49,17 @@ func Query(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		//raw flux can be limited to admins so clients use the series endpoint
+		is_allowed, err := RawQueryAllowed(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking admin: %s", err))
+			return
+		}
+		if !is_allowed {
+			SendError(w, http.StatusForbidden, errors.New("raw flux queries are only allowed for admins"))
+			return
+		}
+
 		//check if Query is valid
 		query := t["query"].(string)
 
@@ -56,9 +69,9 @@ func Query(w http.ResponseWriter, r *http.Request) {
 		}
 
 		//Query influxdb
-		resp, err := QueryInfluxDB(session_token, query)
+		resp, err := RunQuery(r.Context(), session_token, query, t)
 		if err != nil {
-			SendError(w, http.StatusInternalServerError, fmt.Errorf("error querying influxdb: %s", err))
+			SendQueryError(w, err)
 			return
 		}
 
@@ -72,41 +85,128 @@ func Query(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func RawQueryAllowed(session_token string) (bool, error) {
+	//QUERY_RAW=admin limits raw flux to admins
+	if os.Getenv("QUERY_RAW") != "admin" {
+		return true, nil
+	}
+	return IsAdmin(session_token)
+}
+
+func RunQuery(ctx context.Context, session_token string, Query string, t map[string]interface{}) (interface{}, error) {
+	//version 2 answers with typed tables, older clients get line sets, both
+	//downsampled to the points or width of the request
+	points := TargetPoints(t)
+	if version, _ := t["version"].(float64); version >= 2 {
+		resp, err := QueryTablesContext(ctx, session_token, Query)
+		if err != nil || points == 0 {
+			return resp, err
+		}
+		return DownsampleTables(resp, points), nil
+	}
+	resp, err := QueryInfluxDBContext(ctx, session_token, Query)
+	if err != nil || points == 0 {
+		return resp, err
+	}
+	return DownsampleResponse(resp, points), nil
+}
+
 func QueryInfluxDB(session_token string, Query string) (QueryResponse, error) {
 	//Query influxdb with session token and Query
+	return QueryInfluxDBContext(context.Background(), session_token, Query)
+}
+
+func QueryInfluxDBContext(ctx context.Context, session_token string, Query string) (QueryResponse, error) {
+	//Query influxdb with session token and Query, given up when ctx ends
 	//get influxdb token from session
 	influx_token, err := GetInfluxTokenFromSession(session_token)
 	if err != nil {
 		return QueryResponse{}, fmt.Errorf("QueryInfluxDB %s: %s", session_token, err)
 	}
 
+	return queryLineSets(ctx, influx_token, Query)
+}
+
+func QueryInfluxDBWithToken(influx_token string, Query string) (QueryResponse, error) {
+	//Query influxdb with an influxdb token, used by server side jobs without a session,
+	//never cached so control loops and alerts see the latest points
+	queryResponse, err := fetchLineSets(context.Background(), influx_token, Query)
+	if err != nil {
+		return QueryResponse{}, fmt.Errorf("QueryInfluxDB: %w", err)
+	}
+	return queryResponse, nil
+}
+
+func queryLineSets(ctx context.Context, influx_token string, Query string) (QueryResponse, error) {
+	queryResponse, err := cachedQuery("lineSets", influx_token, Query, func() (interface{}, error) {
+		return fetchLineSets(ctx, influx_token, Query)
+	})
+	if err != nil {
+		return QueryResponse{}, fmt.Errorf("QueryInfluxDB: %w", err)
+	}
+	return queryResponse.(QueryResponse), nil
+}
+
+func fetchLineSets(ctx context.Context, influx_token string, Query string) (QueryResponse, error) {
+	resp, err := openInfluxQuery(ctx, queryTimeout(), influx_token, Query)
+	if err != nil {
+		return QueryResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	//read response
+	return ProcessInfluxdbResponse(limitQueryBody(resp.Body))
+}
+
+func openInfluxQuery(ctx context.Context, timeout time.Duration, influx_token string, Query string) (*http.Response, error) {
+	//send a flux query, the caller reads and closes the annotated csv body,
+	//the query is cancelled with ctx or after timeout
 	//http url for influxdb
 	API_URL := os.Getenv("API_URL")
 	ORG_ID := os.Getenv("ORG_ID")
 	httpposturl := API_URL + "/api/v2/query?orgID=" + ORG_ID
 
+	//ask for all annotations so the response carries datatypes and defaults
+	body, err := json.Marshal(map[string]interface{}{
+		"query": Query,
+		"type":  "flux",
+		"dialect": map[string]interface{}{
+			"header":      true,
+			"delimiter":   ",",
+			"annotations": []string{"datatype", "group", "default"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	//create http request
-	req, err := http.NewRequest("POST", httpposturl, bytes.NewBufferString(Query))
-	req.Header.Set("Content-Type", "application/vnd.flux")
-	req.Header.Set("Authorization", "Token "+influx_token)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	req, err := http.NewRequestWithContext(ctx, "POST", httpposturl, bytes.NewBuffer(body))
 	if err != nil {
-		return QueryResponse{}, fmt.Errorf("QueryInfluxDB %s: %s", session_token, err)
+		cancel()
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+	req.Header.Set("Authorization", "Token "+influx_token)
 
 	//send http request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := influxClient.Do(req)
 	if err != nil {
-		return QueryResponse{}, fmt.Errorf("QueryInfluxDB %s: %s", session_token, err)
+		cancel()
+		return nil, queryContextError(ctx, timeout, err)
 	}
-	defer resp.Body.Close()
-
-	//read response
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	respStr := buf.String()
 
-	return ProcessInfluxdbResponse(respStr), nil
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer cancel()
+		defer resp.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(io.LimitReader(resp.Body, 64<<10))
+		return nil, fmt.Errorf("%s: %s", resp.Status, buf.String())
+	}
+	resp.Body = &queryBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, timeout: timeout}
+	return resp, nil
 }
 
 func GetInfluxTokenFromSession(session_token string) (string, error) {
@@ -135,45 +235,52 @@ func GetInfluxTokenFromSession(session_token string) (string, error) {
 	return "", errors.New("GetInfluxTokenFromSession: no token found")
 }
 
-func ProcessInfluxdbResponse(rawResponse string) QueryResponse {
-	//process influxdb response to "QueryResponse"
-	//parse csv in 1 dimensional array
-	linesResponse := strings.Split(rawResponse, "\n")
-	var splitedLinesResponse [][]string
+func ProcessInfluxdbResponse(body io.Reader) (QueryResponse, error) {
+	//process influxdb annotated csv to "QueryResponse", one line set per
+	//table of every result
+	reader := NewFluxReader(body)
 	lineSets := make([][]Pair, 0)
 	names := make([]string, 0)
+	tables := make(map[string]int)
 
-	//parse csv in 2 dimensional array
-	for _, line := range linesResponse {
-		splitedLinesResponse = append(splitedLinesResponse, strings.Split(line, ","))
-	}
-
-	//get amount of tables
-	amount := First(strconv.Atoi(splitedLinesResponse[len(splitedLinesResponse)-3][2])) + 1
-	splitedLinesResponse[len(splitedLinesResponse)-2] = []string{"", "", strconv.Itoa(amount + 1)}
+	rows := newRowLimit()
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = rows.add()
+		}
+		if err != nil {
+			return QueryResponse{}, err
+		}
 
-	prevTableI, tableI := 0, 0
-	j := 1
+		//tables are numbered per result
+		key := record.Result + ":" + strconv.Itoa(record.Table)
+		i, ok := tables[key]
+		if !ok {
+			i = len(lineSets)
+			tables[key] = i
+			lineSets = append(lineSets, make([]Pair, 0))
+			names = append(names, record.Name())
+		}
 
-	//sort data in arrays
-	for i := 0; i < amount; i++ {
-		lineSets = append(lineSets, make([]Pair, 0))
-		for tableI == prevTableI {
-			tableI = First(strconv.Atoi(splitedLinesResponse[j][2]))
-			if tableI == prevTableI {
-				lineSets[i] = append(lineSets[i], Pair{Title: splitedLinesResponse[j][5], Value: First(strconv.ParseFloat(splitedLinesResponse[j][6], 64))})
-			}
-			j++
+		title := ""
+		if t, ok := record.Values["_time"].(time.Time); ok {
+			title = t.Format(time.RFC3339Nano)
 		}
-		names = append(names, strings.Replace(splitedLinesResponse[j-2][10], "\r", "", -1))
-		prevTableI = tableI
+		value, _ := record.Float("_value")
+		lineSets[i] = append(lineSets[i], Pair{Title: title, Value: value})
+	}
+	if len(names) > 0 {
+		log.Printf("Query(first element): %s\n", names[0])
 	}
-	log.Printf("Query(first element): %s\n", splitedLinesResponse[2][10])
 
 	//return data
 	return QueryResponse{
 		LineSets: lineSets,
 		Names:    names,
-		Amount:   amount,
-	}
+		Amount:   len(lineSets),
+	}, nil
 }
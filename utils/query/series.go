@@ -0,0 +1,248 @@
+package Query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+var ErrSeriesQuery = errors.New("invalid series query")
+var ErrSeriesNotAllowed = errors.New("series is not allowed")
+
+// flux durations like -24h, 7d or 1h30m
+var fluxDuration = regexp.MustCompile(`^-?([0-9]+(ns|us|ms|s|m|h|d|w|mo|y))+$`)
+
+func seriesBucket() string {
+	bucket := os.Getenv("QUERY_BUCKET")
+	if bucket == "" {
+		return "lcn"
+	}
+	return bucket
+}
+
+func seriesAllowed(name string) bool {
+	//QUERY_SERIES lists the series clients may query, empty allows all
+	allowed := os.Getenv("QUERY_SERIES")
+	if allowed == "" {
+		return true
+	}
+	for _, series := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(series) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func CheckSeriesAllowed(series []string) error {
+	//clients may only ask for the series in QUERY_SERIES, server side callers
+	//build their queries without this check
+	for _, name := range series {
+		if !seriesAllowed(name) {
+			return fmt.Errorf("%w: %s", ErrSeriesNotAllowed, name)
+		}
+	}
+	return nil
+}
+
+func FluxString(value string) string {
+	//quoted flux string literal, ${ is escaped so names can not interpolate
+	//flux expressions into the query
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			builder.WriteByte('\\')
+			builder.WriteByte(c)
+		case c == '$' && i+1 < len(value) && value[i+1] == '{':
+			builder.WriteString(`\$`)
+		case c == '\n':
+			builder.WriteString(`\n`)
+		case c == '\r':
+			builder.WriteString(`\r`)
+		case c == '\t':
+			builder.WriteString(`\t`)
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	builder.WriteByte('"')
+	return builder.String()
+}
+
+func fluxTime(value string) (string, error) {
+	//a relative flux duration or an absolute RFC3339 time
+	if fluxDuration.MatchString(value) {
+		return value, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s is neither a duration nor a RFC3339 time", ErrSeriesQuery, value)
+	}
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
+
+func BuildSeriesQuery(seriesQuery SeriesQuery) (string, error) {
+	//build the flux for a series query, clients never send flux themselves
+	if len(seriesQuery.Series) == 0 {
+		return "", fmt.Errorf("%w: no series", ErrSeriesQuery)
+	}
+	filters := make([]string, 0, len(seriesQuery.Series))
+	for _, name := range seriesQuery.Series {
+		filters = append(filters, fmt.Sprintf("r[\"name\"] == %s", FluxString(name)))
+	}
+
+	if seriesQuery.Start == "" {
+		seriesQuery.Start = "-1h"
+	}
+	start, err := fluxTime(seriesQuery.Start)
+	if err != nil {
+		return "", err
+	}
+	stop := "now()"
+	if seriesQuery.Stop != "" {
+		stop, err = fluxTime(seriesQuery.Stop)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	switch seriesQuery.Fn {
+	case "", SeriesMean, SeriesMin, SeriesMax, SeriesLast:
+	default:
+		return "", fmt.Errorf("%w: unknown function %s", ErrSeriesQuery, seriesQuery.Fn)
+	}
+	//a point count picks the window so the answer stays below it
+	if seriesQuery.Window == "" && seriesQuery.Points > 0 {
+		seriesQuery.Window, err = seriesWindow(seriesQuery)
+		if err != nil {
+			return "", err
+		}
+	}
+	if seriesQuery.Window != "" {
+		if !fluxDuration.MatchString(seriesQuery.Window) || strings.HasPrefix(seriesQuery.Window, "-") {
+			return "", fmt.Errorf("%w: window %s is no duration", ErrSeriesQuery, seriesQuery.Window)
+		}
+		if seriesQuery.Fn == "" {
+			seriesQuery.Fn = SeriesMean
+		}
+	}
+
+	bucket := FluxString(seriesBucket())
+	queryStr := fmt.Sprintf("from(bucket: %s)\n"+
+		"|> range(start: %s, stop: %s)\n"+
+		"|> filter(fn: (r) => r[\"_measurement\"] == %s)\n"+
+		"|> filter(fn: (r) => %s)", bucket, start, stop, bucket, strings.Join(filters, " or "))
+
+	//aggregate per window or over the whole range
+	switch {
+	case seriesQuery.Window != "":
+		queryStr += fmt.Sprintf("\n|> aggregateWindow(every: %s, fn: %s, createEmpty: false)", seriesQuery.Window, seriesQuery.Fn)
+	case seriesQuery.Fn == SeriesMean:
+		queryStr += "\n|> mean()\n|> duplicate(column: \"_stop\", as: \"_time\")"
+	case seriesQuery.Fn != "":
+		queryStr += fmt.Sprintf("\n|> %s()", seriesQuery.Fn)
+	}
+
+	return queryStr, nil
+}
+
+func QuerySeries(session_token string, seriesQuery SeriesQuery) (QueryResponse, error) {
+	//query named series with the influxdb token of the session
+	queryStr, err := BuildSeriesQuery(seriesQuery)
+	if err != nil {
+		return QueryResponse{}, err
+	}
+	return QueryInfluxDB(session_token, queryStr)
+}
+
+func SeriesQueryFromRequest(t map[string]interface{}) SeriesQuery {
+	//series query from the fields of a decoded request
+	seriesQuery := SeriesQuery{Series: make([]string, 0)}
+	rawSeries, _ := t["series"].([]interface{})
+	for _, rawName := range rawSeries {
+		if name, ok := rawName.(string); ok && name != "" {
+			seriesQuery.Series = append(seriesQuery.Series, name)
+		}
+	}
+	seriesQuery.Start, _ = t["start"].(string)
+	seriesQuery.Stop, _ = t["stop"].(string)
+	seriesQuery.Window, _ = t["window"].(string)
+	seriesQuery.Fn, _ = t["fn"].(string)
+	seriesQuery.Points = TargetPoints(t)
+	return seriesQuery
+}
+
+func Series(w http.ResponseWriter, r *http.Request) {
+	//query named series with session token
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//check if session token is valid
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			SendError(w, http.StatusUnauthorized, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//Query influxdb
+		var resp interface{}
+		var queryStr string
+		seriesQuery := SeriesQueryFromRequest(t)
+		err = CheckSeriesAllowed(seriesQuery.Series)
+		if err == nil {
+			queryStr, err = BuildSeriesQuery(seriesQuery)
+		}
+		if err == nil {
+			resp, err = RunQuery(r.Context(), session_token, queryStr, t)
+		}
+		if errors.Is(err, ErrSeriesQuery) {
+			SendError(w, http.StatusBadRequest, err)
+			return
+		}
+		if errors.Is(err, ErrSeriesNotAllowed) {
+			SendError(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			SendQueryError(w, err)
+			return
+		}
+
+		//send response
+		json.NewEncoder(w).Encode(resp)
+	default:
+		log.Printf(Red + "Sorry, only POST method is supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only POST method is supported."})
+	}
+}
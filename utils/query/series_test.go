@@ -0,0 +1,56 @@
+package Query
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/GineHyte/server/models"
+)
+
+func TestFluxString(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Wohnzimmer", `"Wohnzimmer"`},
+		{`a"b\c`, `"a\"b\\c"`},
+		{"${string(v: 1)}", `"\${string(v: 1)}"`},
+		{"5$ und $x", `"5$ und $x"`},
+		{"Zeile\nZeile", `"Zeile\nZeile"`},
+		{"Küche", `"Küche"`},
+	}
+	for _, test := range tests {
+		if got := FluxString(test.value); got != test.want {
+			t.Errorf("FluxString(%q): got %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestBuildSeriesQueryEscapesNames(t *testing.T) {
+	t.Setenv("QUERY_SERIES", "")
+
+	queryStr, err := BuildSeriesQuery(SeriesQuery{Series: []string{`x" or true or "${r._value}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(queryStr, `r["name"] == "x\" or true or \"\${r._value}"`) {
+		t.Errorf("name not escaped:\n%s", queryStr)
+	}
+}
+
+func TestSeriesAllowlist(t *testing.T) {
+	t.Setenv("QUERY_SERIES", "Wohnzimmer, Bad")
+
+	if err := CheckSeriesAllowed([]string{"Wohnzimmer", "Bad"}); err != nil {
+		t.Errorf("got %s for allowed series", err)
+	}
+	if err := CheckSeriesAllowed([]string{"Bad", "Keller"}); !errors.Is(err, ErrSeriesNotAllowed) {
+		t.Errorf("got %v, want %s", err, ErrSeriesNotAllowed)
+	}
+
+	//server side callers build queries for any series
+	if _, err := BuildSeriesQuery(SeriesQuery{Series: []string{"Keller"}}); err != nil {
+		t.Errorf("got %s for a series outside the allowlist", err)
+	}
+}
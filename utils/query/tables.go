@@ -0,0 +1,201 @@
+package Query
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+)
+
+// columns every flux table carries that are neither tags nor fields
+var fluxMetaColumns = map[string]bool{
+	"result": true,
+	"table":  true,
+	"_start": true,
+	"_stop":  true,
+	"_time":  true,
+	"_field": true,
+	"_value": true,
+}
+
+func QueryTables(session_token string, Query string) (QueryTablesResponse, error) {
+	//Query influxdb with session token and Query, answered as typed tables
+	return QueryTablesContext(context.Background(), session_token, Query)
+}
+
+func QueryTablesContext(ctx context.Context, session_token string, Query string) (QueryTablesResponse, error) {
+	influx_token, err := GetInfluxTokenFromSession(session_token)
+	if err != nil {
+		return QueryTablesResponse{}, fmt.Errorf("QueryTables %s: %s", session_token, err)
+	}
+
+	return queryTables(ctx, influx_token, Query)
+}
+
+func QueryTablesWithToken(influx_token string, Query string) (QueryTablesResponse, error) {
+	//server side queries are never cached
+	tables, err := fetchTables(context.Background(), influx_token, Query)
+	if err != nil {
+		return QueryTablesResponse{}, fmt.Errorf("QueryTables: %w", err)
+	}
+	return tables, nil
+}
+
+func queryTables(ctx context.Context, influx_token string, Query string) (QueryTablesResponse, error) {
+	tables, err := cachedQuery("tables", influx_token, Query, func() (interface{}, error) {
+		return fetchTables(ctx, influx_token, Query)
+	})
+	if err != nil {
+		return QueryTablesResponse{}, fmt.Errorf("QueryTables: %w", err)
+	}
+	return tables.(QueryTablesResponse), nil
+}
+
+func fetchTables(ctx context.Context, influx_token string, Query string) (QueryTablesResponse, error) {
+	resp, err := openInfluxQuery(ctx, queryTimeout(), influx_token, Query)
+	if err != nil {
+		return QueryTablesResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	return ProcessInfluxdbTables(limitQueryBody(resp.Body))
+}
+
+func ProcessInfluxdbTables(body io.Reader) (QueryTablesResponse, error) {
+	//one table per result and tag set, the fields of a series are merged
+	//into one row per timestamp
+	reader := NewFluxReader(body)
+	tables := make([]QueryTable, 0)
+	tableIndex := make(map[string]int)
+	rowIndex := make(map[string]int)
+
+	rows := newRowLimit()
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = rows.add()
+		}
+		if err != nil {
+			return QueryTablesResponse{}, err
+		}
+
+		tags := recordTags(record)
+		key := record.Result + "\x00" + tagsKey(tags)
+		i, ok := tableIndex[key]
+		if !ok {
+			i = len(tables)
+			tableIndex[key] = i
+			tables = append(tables, QueryTable{Name: record.Name(), Result: record.Result, Tags: tags, Fields: make([]string, 0), Rows: make([]QueryRow, 0)})
+		}
+		table := &tables[i]
+
+		//rows of the same series and time share their fields
+		var rowTime *time.Time
+		timeKey := ""
+		if t, ok := record.Values["_time"].(time.Time); ok {
+			rowTime = &t
+			timeKey = t.Format(time.RFC3339Nano)
+		}
+		j, ok := rowIndex[key+"\x00"+timeKey]
+		if !ok || rowTime == nil {
+			j = len(table.Rows)
+			rowIndex[key+"\x00"+timeKey] = j
+			table.Rows = append(table.Rows, QueryRow{Time: rowTime, Fields: make(map[string]interface{})})
+		}
+
+		fields := recordFields(record)
+		for name := range fields {
+			if !containsString(table.Fields, name) {
+				table.Fields = append(table.Fields, name)
+			}
+			table.Rows[j].Fields[name] = jsonFluxValue(fields[name])
+		}
+		sortFields(table.Fields, record.Columns)
+	}
+
+	return QueryTablesResponse{Version: 2, Tables: tables, Amount: len(tables)}, nil
+}
+
+func recordTags(record FluxRecord) map[string]string {
+	//group key columns without the flux meta columns
+	tags := make(map[string]string)
+	for _, column := range record.Columns {
+		if !column.Group || fluxMetaColumns[column.Name] {
+			continue
+		}
+		if value := record.Values[column.Name]; value != nil {
+			tags[column.Name] = fmt.Sprint(value)
+		}
+	}
+	return tags
+}
+
+func recordFields(record FluxRecord) map[string]interface{} {
+	//a _field/_value pair, or every other column of pivoted and mapped tables
+	if field, ok := record.Values["_field"].(string); ok {
+		return map[string]interface{}{field: record.Values["_value"]}
+	}
+	fields := make(map[string]interface{})
+	for _, column := range record.Columns {
+		if column.Group || (fluxMetaColumns[column.Name] && column.Name != "_value") {
+			continue
+		}
+		fields[column.Name] = record.Values[column.Name]
+	}
+	return fields
+}
+
+func sortFields(fields []string, columns []FluxColumn) {
+	//fields of pivoted tables keep their column order, others stay in the
+	//order they first appeared
+	position := make(map[string]int, len(columns))
+	for i, column := range columns {
+		position[column.Name] = i + 1
+	}
+	sort.SliceStable(fields, func(a, b int) bool {
+		pa, pb := position[fields[a]], position[fields[b]]
+		return pa != 0 && pb != 0 && pa < pb
+	})
+}
+
+func tagsKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	for _, key := range keys {
+		builder.WriteString(key + "=" + tags[key] + "\x00")
+	}
+	return builder.String()
+}
+
+func jsonFluxValue(value interface{}) interface{} {
+	//durations and binary values have no useful json form of their own
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	}
+	return value
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,410 @@
+package schalter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+// proposed changes of the last discovery run
+var discoveryChanges = make([]SchalterDiscoveryChange, 0)
+var discoveryRun *time.Time
+var discoveryMu sync.Mutex
+
+func SchalterDiscoveryJob() {
+	//look for new, removed and renamed devices every SCHALTER_DISCOVERY_INTERVAL minutes
+	interval, err := strconv.Atoi(os.Getenv("SCHALTER_DISCOVERY_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = 60
+	}
+
+	for {
+		changes, err := RunSchalterDiscovery()
+		if err != nil {
+			log.Printf(Red+"error discovering schalter: %s\n"+Reset, err)
+		} else if len(changes) > 0 {
+			log.Printf(Yellow+"schalter discovery: %d proposed changes\n"+Reset, len(changes))
+		}
+		time.Sleep(time.Duration(interval) * time.Minute)
+	}
+}
+
+func RunSchalterDiscovery() ([]SchalterDiscoveryChange, error) {
+	//compare the widgets of the configured pages with sys.Schalter
+	pages, err := GetSchalterPages()
+	if err != nil {
+		return []SchalterDiscoveryChange{}, fmt.Errorf("runSchalterDiscovery: %s", err)
+	}
+
+	discovered := make([]SchalterDiscoveryChange, 0)
+	sitemaps := make(map[string]bool)
+	for _, page := range pages {
+		if sitemaps[page.Sitemap] {
+			continue
+		}
+		sitemaps[page.Sitemap] = true
+
+		_, widgets, err := DiscoverSitemap(page.Sitemap)
+		if err != nil {
+			return []SchalterDiscoveryChange{}, fmt.Errorf("runSchalterDiscovery: %s", err)
+		}
+		discovered = append(discovered, discoveredDevices(widgets, pages)...)
+	}
+
+	dbStatuses, err := GetSchalterStatuses()
+	if err != nil {
+		return []SchalterDiscoveryChange{}, fmt.Errorf("runSchalterDiscovery: %s", err)
+	}
+
+	//MQTT devices are not part of any sitemap, devices on pages that were
+	//not scanned are left alone
+	mqttNames, err := GetMqttDeviceNames()
+	if err != nil {
+		return []SchalterDiscoveryChange{}, fmt.Errorf("runSchalterDiscovery: %s", err)
+	}
+	openhabStatuses := make([]SchalterStatus, 0)
+	for _, dbStatus := range dbStatuses {
+		if mqttNames[dbStatus.Name] || !onScannedPage(dbStatus.WidgetId, pages) {
+			continue
+		}
+		openhabStatuses = append(openhabStatuses, dbStatus)
+	}
+
+	changes := diffDiscoveredDevices(discovered, openhabStatuses)
+
+	discoveryMu.Lock()
+	now := time.Now()
+	discoveryChanges = changes
+	discoveryRun = &now
+	discoveryMu.Unlock()
+
+	return changes, nil
+}
+
+func discoveredDevices(widgets []SitemapWidget, pages []SchalterPage) []SchalterDiscoveryChange {
+	//one device per widget, a shutter is a direction widget and the power widget after it
+	devices := make([]SchalterDiscoveryChange, 0)
+	for i := 0; i < len(widgets); i++ {
+		widget := widgets[i]
+		if !containsPage(pages, widget.Sitemap, widget.Page) {
+			continue
+		}
+		device := SchalterDiscoveryChange{Action: DiscoveryAdd, Name: widget.Item, WidgetId: widget.WidgetId, Label: widget.Label, State: widget.State, Sitemap: widget.Sitemap, Page: widget.Page}
+
+		if strings.Contains(widget.Item, "Richtung") {
+			device.Type = TypeShutter
+			device.Name = strings.TrimSpace(widget.Label)
+			if device.Name == "" {
+				device.Name = strings.TrimSpace(strings.ReplaceAll(widget.Item, "Richtung", ""))
+			}
+			if i+1 < len(widgets) && widgets[i+1].Page == widget.Page {
+				i++
+			}
+			devices = append(devices, device)
+			continue
+		}
+
+		device.Type = itemSchalterType(widget.ItemType)
+		if device.Type == "" {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+func onScannedPage(widgetId string, pages []SchalterPage) bool {
+	//widget ids start with the id of their page
+	for _, page := range pages {
+		if strings.HasPrefix(widgetId, page.Page) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPage(pages []SchalterPage, sitemap string, page string) bool {
+	for _, p := range pages {
+		if p.Sitemap == sitemap && p.Page == page {
+			return true
+		}
+	}
+	return false
+}
+
+func itemSchalterType(itemType string) string {
+	//device type for an openHAB item type, empty for items we can not control
+	switch {
+	case itemType == "Switch":
+		return TypeSwitch
+	case itemType == "Dimmer":
+		return TypeDimmer
+	case itemType == "Color":
+		return TypeColor
+	case strings.HasPrefix(itemType, "Number"):
+		return TypeSetpoint
+	}
+	return ""
+}
+
+func diffDiscoveredDevices(discovered []SchalterDiscoveryChange, dbStatuses []SchalterStatus) []SchalterDiscoveryChange {
+	//single item devices are stored by item name, shutters by their direction widget
+	matched := make(map[string]bool)
+	changes := make([]SchalterDiscoveryChange, 0)
+
+	unknown := make([]SchalterDiscoveryChange, 0)
+	for _, device := range discovered {
+		found := false
+		for _, dbStatus := range dbStatuses {
+			if (device.Type == TypeShutter) != (dbStatus.Type == TypeShutter) {
+				continue
+			}
+			if device.Type == TypeShutter && dbStatus.WidgetId == device.WidgetId || device.Type != TypeShutter && dbStatus.Name == device.Name {
+				matched[dbStatus.Name] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, device)
+		}
+	}
+
+	for _, device := range unknown {
+		//a device that kept its widget or its name was renamed or moved
+		for _, dbStatus := range dbStatuses {
+			if matched[dbStatus.Name] || (device.Type == TypeShutter) != (dbStatus.Type == TypeShutter) {
+				continue
+			}
+			if dbStatus.WidgetId == device.WidgetId || dbStatus.Name == device.Name {
+				matched[dbStatus.Name] = true
+				device.Action = DiscoveryRename
+				device.OldName = dbStatus.Name
+				break
+			}
+		}
+		device.Id = device.Action + ":" + device.Sitemap + ":" + device.WidgetId
+		changes = append(changes, device)
+	}
+
+	for _, dbStatus := range dbStatuses {
+		if matched[dbStatus.Name] {
+			continue
+		}
+		changes = append(changes, SchalterDiscoveryChange{Id: DiscoveryRemove + ":" + dbStatus.Name, Action: DiscoveryRemove, Name: dbStatus.Name, WidgetId: dbStatus.WidgetId, Type: dbStatus.Type, State: dbStatus.State})
+	}
+
+	return changes
+}
+
+func GetSchalterDiscovery() ([]SchalterDiscoveryChange, *time.Time) {
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+
+	changes := make([]SchalterDiscoveryChange, len(discoveryChanges))
+	copy(changes, discoveryChanges)
+	return changes, discoveryRun
+}
+
+func AcceptSchalterDiscovery(ids []string, all bool) []SchalterCommandResult {
+	//apply the proposed changes with the given ids, all adds and renames if
+	//all is set, removals always need their id
+	changes, _ := GetSchalterDiscovery()
+	results := make([]SchalterCommandResult, 0)
+	accepted := make(map[string]bool)
+
+	for _, change := range changes {
+		selected := containsString(ids, change.Id) || all && change.Action != DiscoveryRemove
+		if !selected {
+			continue
+		}
+		result := SchalterCommandResult{Name: change.Name, Success: true}
+		err := applyDiscoveryChange(change)
+		if err != nil {
+			result.Success = false
+			result.Error = err.Error()
+		} else {
+			accepted[change.Id] = true
+		}
+		results = append(results, result)
+	}
+
+	//accepted changes are no longer proposed
+	discoveryMu.Lock()
+	remaining := make([]SchalterDiscoveryChange, 0)
+	for _, change := range discoveryChanges {
+		if !accepted[change.Id] {
+			remaining = append(remaining, change)
+		}
+	}
+	discoveryChanges = remaining
+	discoveryMu.Unlock()
+
+	return results
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func applyDiscoveryChange(change SchalterDiscoveryChange) error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("applyDiscoveryChange: %s", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("applyDiscoveryChange: %s", err)
+	}
+	defer tx.Rollback()
+
+	switch change.Action {
+	case DiscoveryAdd:
+		state := change.State
+		if change.Type == TypeShutter || state == "NULL" || state == "UNDEF" {
+			state = "OFF"
+		}
+		_, err = tx.Exec("INSERT INTO sys.Schalter (name, state, widgetId, scriptState) VALUES (?, ?, ?, false)", change.Name, state, change.WidgetId)
+		if err == nil && change.Type != defaultSchalterType(change.Name) {
+			_, err = tx.Exec("INSERT INTO sys.SchalterTypes (name, type) VALUES (?, ?) ON DUPLICATE KEY UPDATE type = VALUES(type)", change.Name, change.Type)
+		}
+	case DiscoveryRename:
+		_, err = tx.Exec("UPDATE sys.Schalter SET name = ?, widgetId = ? WHERE name = ?", change.Name, change.WidgetId, change.OldName)
+		for _, table := range []string{"sys.SchalterRooms", "sys.SchalterTypes", "sys.SchalterGroups"} {
+			if err == nil && change.Name != change.OldName {
+				_, err = tx.Exec("UPDATE "+table+" SET name = ? WHERE name = ?", change.Name, change.OldName)
+			}
+		}
+	case DiscoveryRemove:
+		_, err = tx.Exec("DELETE FROM sys.Schalter WHERE name = ?", change.Name)
+		for _, table := range []string{"sys.SchalterRooms", "sys.SchalterTypes", "sys.SchalterGroups"} {
+			if err == nil {
+				_, err = tx.Exec("DELETE FROM "+table+" WHERE name = ?", change.Name)
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown action %s", change.Action)
+	}
+	if err != nil {
+		return fmt.Errorf("applyDiscoveryChange: %s", err)
+	}
+
+	return tx.Commit()
+}
+
+func SchalterDiscovery(w http.ResponseWriter, r *http.Request) {
+	//list proposed device changes, accept them as admin
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("refresh") == "true" {
+			//a scan asks openHAB for every sitemap, only admins start one
+			session_token := r.URL.Query().Get("session_token")
+			if session_token == "" {
+				SendError(w, http.StatusUnauthorized, errors.New("no session token"))
+				return
+			}
+			is_valid, err := CheckSession(session_token)
+			if err != nil {
+				SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+				return
+			}
+			if !is_valid {
+				SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+				return
+			}
+			is_admin, err := IsAdmin(session_token)
+			if err != nil {
+				SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking admin: %s", err))
+				return
+			}
+			if !is_admin {
+				SendError(w, http.StatusForbidden, errors.New("admin rights required"))
+				return
+			}
+
+			_, err = RunSchalterDiscovery()
+			if err != nil {
+				SendError(w, http.StatusBadGateway, fmt.Errorf("error discovering schalter: %s", err))
+				return
+			}
+		}
+		changes, lastRun := GetSchalterDiscovery()
+		json.NewEncoder(w).Encode(map[string]interface{}{"changes": changes, "lastRun": lastRun})
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//only admins change the device table
+		is_admin, err := IsAdmin(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking admin: %s", err))
+			return
+		}
+		if !is_admin {
+			SendError(w, http.StatusForbidden, errors.New("admin rights required"))
+			return
+		}
+
+		//changes are accepted by id, all only covers adds and renames
+		rawIds, _ := t["ids"].([]interface{})
+		ids := make([]string, 0)
+		for _, rawId := range rawIds {
+			if id, ok := rawId.(string); ok && id != "" {
+				ids = append(ids, id)
+			}
+		}
+		all, _ := t["all"].(bool)
+		if len(ids) == 0 && !all {
+			SendError(w, http.StatusBadRequest, errors.New("no ids"))
+			return
+		}
+
+		json.NewEncoder(w).Encode(AcceptSchalterDiscovery(ids, all))
+	default:
+		log.Printf(Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}
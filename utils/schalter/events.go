@@ -0,0 +1,207 @@
+package schalter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+var EventState = "state"
+var EventLock = "lock"
+var EventScript = "script"
+var EventSnapshot = "snapshot"
+var EventPreempt = "preempt"
+
+// the last events are kept so a client can resume with Last-Event-ID
+var eventBacklogSize = 256
+
+var events = make([]SchalterEvent, 0, eventBacklogSize)
+var eventId = 0
+var eventSubscribers = make(map[chan SchalterEvent]bool)
+var eventsMu sync.Mutex
+
+func PublishSchalterEvent(eventType string, name string, widgetId ...string) {
+	publishSchalterEvent(eventType, nil, name, widgetId...)
+}
+
+func publishSchalterEvent(eventType string, preempted *SchalterSource, name string, widgetId ...string) {
+	//send the current status of a Schalter to every subscriber
+	status, err := GetSchalterStatus(name, widgetId...)
+	if err != nil {
+		log.Printf(Red+"error publishing schalter event: %s\n"+Reset, err)
+		return
+	}
+
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	eventId++
+	event := SchalterEvent{Id: eventId, Type: eventType, Time: time.Now(), Status: &status, Preempted: preempted}
+	if len(events) == eventBacklogSize {
+		events = events[1:]
+	}
+	events = append(events, event)
+
+	for ch := range eventSubscribers {
+		select {
+		case ch <- event:
+		default:
+			//slow clients are dropped and resume with Last-Event-ID
+			delete(eventSubscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func subscribeSchalterEvents(lastEventId int) (chan SchalterEvent, []SchalterEvent, bool) {
+	//returns the channel and the missed events, false if a snapshot is needed
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	ch := make(chan SchalterEvent, 64)
+	eventSubscribers[ch] = true
+
+	if lastEventId < 0 || lastEventId > eventId {
+		return ch, nil, false
+	}
+	if len(events) > 0 && lastEventId < events[0].Id-1 {
+		return ch, nil, false
+	}
+	if len(events) == 0 && lastEventId != eventId {
+		return ch, nil, false
+	}
+
+	missed := make([]SchalterEvent, 0)
+	for _, event := range events {
+		if event.Id > lastEventId {
+			missed = append(missed, event)
+		}
+	}
+	return ch, missed, true
+}
+
+func unsubscribeSchalterEvents(ch chan SchalterEvent) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	if eventSubscribers[ch] {
+		delete(eventSubscribers, ch)
+		close(ch)
+	}
+}
+
+func currentEventId() int {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	return eventId
+}
+
+func formatSchalterEvent(id int, event string, data any) (string, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", id, event, payload), nil
+}
+
+func SchalterEvents(w http.ResponseWriter, r *http.Request) {
+	//stream every Schalter change as server sent events
+	//check if session token is valid
+	session_token := r.URL.Query().Get("session_token")
+	if session_token == "" {
+		http.Error(w, "no session token", http.StatusUnauthorized)
+		return
+	}
+	is_valid, err := CheckSession(session_token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error checking session: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if !is_valid {
+		http.Error(w, "session token is invalid", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "SSE not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventId := -1
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		lastEventId, _ = strconv.Atoi(header)
+	} else if param := r.URL.Query().Get("lastEventId"); param != "" {
+		lastEventId, _ = strconv.Atoi(param)
+	}
+
+	ch, missed, resumed := subscribeSchalterEvents(lastEventId)
+	defer unsubscribeSchalterEvents(ch)
+
+	if !resumed {
+		//initial full snapshot, events published meanwhile follow on ch
+		snapshotId := currentEventId()
+		statuses, err := GetSchalterStatuses()
+		if err != nil {
+			log.Printf(Red+"error getting schalter snapshot: %s\n"+Reset, err)
+			return
+		}
+		event, err := formatSchalterEvent(snapshotId, EventSnapshot, statuses)
+		if err != nil {
+			log.Printf(Red+"error formatting schalter snapshot: %s\n"+Reset, err)
+			return
+		}
+		fmt.Fprint(w, event)
+	}
+	for _, missedEvent := range missed {
+		event, err := formatSchalterEvent(missedEvent.Id, missedEvent.Type, missedEvent)
+		if err != nil {
+			log.Printf(Red+"error formatting schalter event: %s\n"+Reset, err)
+			return
+		}
+		fmt.Fprint(w, event)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case schalterEvent, ok := <-ch:
+			if !ok {
+				return
+			}
+			event, err := formatSchalterEvent(schalterEvent.Id, schalterEvent.Type, schalterEvent)
+			if err != nil {
+				log.Printf(Red+"error formatting schalter event: %s\n"+Reset, err)
+				return
+			}
+			_, err = fmt.Fprint(w, event)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
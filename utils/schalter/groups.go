@@ -0,0 +1,309 @@
+package schalter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+func CreateSchalterGroupTables() error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("createSchalterGroupTables: %s", err)
+	}
+	defer db.Close()
+
+	//room and floor of every schalter
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.SchalterRooms (name VARCHAR(255) NOT NULL PRIMARY KEY, room VARCHAR(255) NOT NULL DEFAULT '', floor VARCHAR(255) NOT NULL DEFAULT '')")
+	if err != nil {
+		return fmt.Errorf("createSchalterGroupTables: %s", err)
+	}
+
+	//arbitrary groups, one row per member
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.SchalterGroups (groupName VARCHAR(255) NOT NULL, name VARCHAR(255) NOT NULL, PRIMARY KEY (groupName, name))")
+	if err != nil {
+		return fmt.Errorf("createSchalterGroupTables: %s", err)
+	}
+
+	return nil
+}
+
+func SchalterGroups(w http.ResponseWriter, r *http.Request) {
+	//manage Schalter groups with session token
+	switch r.Method {
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//check if group is valid
+		group, _ := t["group"].(string)
+		if group == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no group"))
+			return
+		}
+
+		//delete group if no members are given
+		rawMembers, _ := t["members"].([]interface{})
+		members := make([]string, 0)
+		for _, member := range rawMembers {
+			if name, ok := member.(string); ok && name != "" {
+				members = append(members, name)
+			}
+		}
+
+		err = SetSchalterGroup(group, members)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error setting schalter group: %s", err))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	case "GET":
+		//get all groups
+		groups, err := GetSchalterGroups()
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting schalter groups: %s", err))
+			return
+		}
+		json.NewEncoder(w).Encode(groups)
+		return
+	default:
+		log.Printf(Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}
+
+func SchalterRooms(w http.ResponseWriter, r *http.Request) {
+	//assign room and floor to a Schalter with session token
+	switch r.Method {
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//check if name is valid
+		name, _ := t["name"].(string)
+		if name == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no name"))
+			return
+		}
+		room, _ := t["room"].(string)
+		floor, _ := t["floor"].(string)
+
+		err = SetSchalterRoom(name, room, floor)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error setting schalter room: %s", err))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	default:
+		log.Printf(Red + "Sorry, only POST method is supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only POST method is supported."})
+	}
+}
+
+func GetSchalterGroups() ([]SchalterGroup, error) {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return []SchalterGroup{}, fmt.Errorf("getSchalterGroups: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT groupName, name FROM sys.SchalterGroups ORDER BY groupName, name")
+	if err != nil {
+		return []SchalterGroup{}, fmt.Errorf("getSchalterGroups: %s", err)
+	}
+	defer rows.Close()
+
+	groups := make([]SchalterGroup, 0)
+	for rows.Next() {
+		var groupName string
+		var name string
+		err := rows.Scan(&groupName, &name)
+		if err != nil {
+			return []SchalterGroup{}, fmt.Errorf("getSchalterGroups: %s", err)
+		}
+
+		//rows are ordered, so a new group starts when the name changes
+		if len(groups) == 0 || groups[len(groups)-1].Name != groupName {
+			groups = append(groups, SchalterGroup{Name: groupName, Members: make([]string, 0)})
+		}
+		groups[len(groups)-1].Members = append(groups[len(groups)-1].Members, name)
+	}
+
+	return groups, nil
+}
+
+func SetSchalterGroup(group string, members []string) error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("setSchalterGroup: %s", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("setSchalterGroup: %s", err)
+	}
+	defer tx.Rollback()
+
+	//replace all members of the group
+	_, err = tx.Exec("DELETE FROM sys.SchalterGroups WHERE groupName = ?", group)
+	if err != nil {
+		return fmt.Errorf("setSchalterGroup: %s", err)
+	}
+	for _, member := range members {
+		_, err = tx.Exec("INSERT INTO sys.SchalterGroups (groupName, name) VALUES (?, ?)", group, member)
+		if err != nil {
+			return fmt.Errorf("setSchalterGroup: %s", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func SetSchalterRoom(name string, room string, floor string) error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("setSchalterRoom: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO sys.SchalterRooms (name, room, floor) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE room = VALUES(room), floor = VALUES(floor)", name, room, floor)
+	if err != nil {
+		return fmt.Errorf("setSchalterRoom: %s", err)
+	}
+
+	return nil
+}
+
+func GetSchalterGroupMembers(group string, room string, floor string) ([]SchalterStatus, error) {
+	//get all Schalter matching every given filter
+	statuses, err := GetSchalterStatuses()
+	if err != nil {
+		return []SchalterStatus{}, fmt.Errorf("getSchalterGroupMembers: %s", err)
+	}
+
+	var groupMembers map[string]bool
+	if group != "" {
+		groups, err := GetSchalterGroups()
+		if err != nil {
+			return []SchalterStatus{}, fmt.Errorf("getSchalterGroupMembers: %s", err)
+		}
+		groupMembers = make(map[string]bool)
+		for _, g := range groups {
+			if g.Name != group {
+				continue
+			}
+			for _, member := range g.Members {
+				groupMembers[member] = true
+			}
+		}
+	}
+
+	members := make([]SchalterStatus, 0)
+	for _, status := range statuses {
+		if room != "" && status.Room != room {
+			continue
+		}
+		if floor != "" && status.Floor != floor {
+			continue
+		}
+		if groupMembers != nil && !groupMembers[status.Name] {
+			continue
+		}
+		members = append(members, status)
+	}
+
+	return members, nil
+}
+
+func SchalterGroupCommand(members []SchalterStatus, state string, locked int, owner SchalterSource) ([]SchalterCommandResult, error) {
+	//send the command to every member, locked members are skipped
+	//the command has to fit every member before any of them is switched
+	if strings.TrimSpace(state) == "" {
+		return []SchalterCommandResult{}, fmt.Errorf("%w: no state", ErrSchalterValue)
+	}
+	for _, member := range members {
+		_, err := NormalizeSchalterCommand(member.Type, state)
+		if err != nil {
+			return []SchalterCommandResult{}, fmt.Errorf("%s: %w", member.Name, err)
+		}
+	}
+
+	results := make([]SchalterCommandResult, 0, len(members))
+	for _, member := range members {
+		command := member
+		command.State = state
+		command.Locked = locked
+
+		err := RunSchalterCommand(command, owner)
+		if err != nil && !errors.Is(err, ErrSchalterAlreadySet) {
+			log.Printf(Red+"error running group command for %s: %s\n"+Reset, member.Name, err)
+			results = append(results, SchalterCommandResult{Name: member.Name, Success: false, Error: err.Error()})
+			continue
+		}
+		results = append(results, SchalterCommandResult{Name: member.Name, Success: true})
+	}
+	return results, nil
+}
@@ -0,0 +1,193 @@
+package schalter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+func CreateHistoryTable() error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("createHistoryTable: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.SchalterHistory (id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, name VARCHAR(255) NOT NULL, oldState VARCHAR(255) NOT NULL, newState VARCHAR(255) NOT NULL, sourceType VARCHAR(32) NOT NULL, sourceId VARCHAR(255) NOT NULL, time BIGINT NOT NULL, INDEX (name, time))")
+	if err != nil {
+		return fmt.Errorf("createHistoryTable: %s", err)
+	}
+
+	return nil
+}
+
+func RecordSchalterHistory(name string, oldState string, newState string, source SchalterSource) {
+	//store a state change, history must never block a command
+	entry := SchalterHistoryEntry{Name: name, OldState: oldState, NewState: newState, Source: source, Time: time.Now()}
+
+	db, err := DBConnection()
+	if err != nil {
+		log.Printf(Red+"error recording schalter history: %s\n"+Reset, err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO sys.SchalterHistory (name, oldState, newState, sourceType, sourceId, time) VALUES (?, ?, ?, ?, ?, ?)", entry.Name, entry.OldState, entry.NewState, entry.Source.Type, entry.Source.Id, entry.Time.UnixMilli())
+	if err != nil {
+		log.Printf(Red+"error recording schalter history: %s\n"+Reset, err)
+	}
+
+	if os.Getenv("HISTORY_BUCKET") != "" {
+		go mirrorHistoryToInflux(entry)
+	}
+}
+
+func mirrorHistoryToInflux(entry SchalterHistoryEntry) {
+	//write the change as measurement "schalter" into HISTORY_BUCKET
+	API_URL := os.Getenv("API_URL")
+	ORG_ID := os.Getenv("ORG_ID")
+	ADMIN_TOKEN := os.Getenv("ADMIN_TOKEN")
+	httpposturl := API_URL + "/api/v2/write?orgID=" + url.QueryEscape(ORG_ID) + "&bucket=" + url.QueryEscape(os.Getenv("HISTORY_BUCKET")) + "&precision=ms"
+
+	line := fmt.Sprintf("schalter,name=%s,sourceType=%s,sourceId=%s state=%s,oldState=%s %d",
+		escapeTag(entry.Name), escapeTag(entry.Source.Type), escapeTag(entry.Source.Id),
+		strconv.Quote(entry.NewState), strconv.Quote(entry.OldState), entry.Time.UnixMilli())
+
+	req, err := http.NewRequest("POST", httpposturl, bytes.NewBufferString(line))
+	if err != nil {
+		log.Printf(Red+"error mirroring schalter history: %s\n"+Reset, err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Authorization", "Token "+ADMIN_TOKEN)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf(Red+"error mirroring schalter history: %s\n"+Reset, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf(Red+"error mirroring schalter history: %s\n"+Reset, resp.Status)
+	}
+}
+
+func escapeTag(value string) string {
+	//line protocol tag values escape commas, equal signs and spaces
+	if value == "" {
+		return "none"
+	}
+	return strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ").Replace(value)
+}
+
+func GetSchalterHistory(name string, from time.Time, to time.Time) ([]SchalterHistoryEntry, error) {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return []SchalterHistoryEntry{}, fmt.Errorf("getSchalterHistory: %s", err)
+	}
+	defer db.Close()
+
+	query := "SELECT name, oldState, newState, sourceType, sourceId, time FROM sys.SchalterHistory WHERE time >= ? AND time <= ?"
+	args := []interface{}{from.UnixMilli(), to.UnixMilli()}
+	if name != "" {
+		query += " AND name = ?"
+		args = append(args, name)
+	}
+	query += " ORDER BY time"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return []SchalterHistoryEntry{}, fmt.Errorf("getSchalterHistory: %s", err)
+	}
+	defer rows.Close()
+
+	history := make([]SchalterHistoryEntry, 0)
+	for rows.Next() {
+		var entry SchalterHistoryEntry
+		var changed int64
+		err := rows.Scan(&entry.Name, &entry.OldState, &entry.NewState, &entry.Source.Type, &entry.Source.Id, &changed)
+		if err != nil {
+			return []SchalterHistoryEntry{}, fmt.Errorf("getSchalterHistory: %s", err)
+		}
+		entry.Time = time.UnixMilli(changed)
+		history = append(history, entry)
+	}
+
+	return history, nil
+}
+
+func parseHistoryTime(raw string, fallback time.Time) (time.Time, error) {
+	//RFC3339 or unix milliseconds
+	if raw == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	ms, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s", raw)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+func SchalterHistory(w http.ResponseWriter, r *http.Request) {
+	//state changes of one or all Schalter in a time range
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		params := r.URL.Query()
+
+		//check if session token is valid
+		session_token := params.Get("session_token")
+		if session_token == "" {
+			SendError(w, http.StatusUnauthorized, errors.New("no session token"))
+			return
+		}
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		from, err := parseHistoryTime(params.Get("from"), time.Now().Add(-24*time.Hour))
+		if err != nil {
+			SendError(w, http.StatusBadRequest, err)
+			return
+		}
+		to, err := parseHistoryTime(params.Get("to"), time.Now())
+		if err != nil {
+			SendError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		history, err := GetSchalterHistory(params.Get("name"), from, to)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting schalter history: %s", err))
+			return
+		}
+		json.NewEncoder(w).Encode(history)
+	default:
+		log.Printf(Red + "Sorry, only GET method is supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET method is supported."})
+	}
+}
@@ -0,0 +1,150 @@
+package schalter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+)
+
+var ErrSchalterInterlock = errors.New("schalter interlock")
+
+// a shutter motor is driven by a direction item and a power item, every
+// command for the same power item goes through one motorState
+type motorState struct {
+	mu        sync.Mutex
+	direction string
+	last      string
+	owner     SchalterSource
+	stopped   time.Time
+	timer     *time.Timer
+	done      func(completed bool)
+	gen       int
+}
+
+var motors = make(map[string]*motorState)
+var motorsMu sync.Mutex
+
+func getMotor(powerItem string) *motorState {
+	motorsMu.Lock()
+	defer motorsMu.Unlock()
+
+	motor, ok := motors[powerItem]
+	if !ok {
+		motor = &motorState{}
+		motors[powerItem] = motor
+	}
+	return motor
+}
+
+func motorDeadTime() time.Duration {
+	//pause between stopping a motor and driving it the other way
+	deadTime, err := strconv.Atoi(os.Getenv("SCHALTER_DEAD_TIME"))
+	if err != nil || deadTime < 0 {
+		return 1 * time.Second
+	}
+	return time.Duration(deadTime) * time.Millisecond
+}
+
+func DriveMotor(directionItem string, powerItem string, direction string, runTime time.Duration, owner SchalterSource, done func(completed bool)) error {
+	//drive a motor in direction for runTime, done is called once the motor
+	//stopped (completed) or the command was superseded by a newer one
+	motor := getMotor(powerItem)
+	motor.mu.Lock()
+	defer motor.mu.Unlock()
+
+	if motor.direction != "" {
+		if motor.direction != direction && motor.owner != owner && !CanPreempt(owner, motor.owner) {
+			return fmt.Errorf("%w: %s is moving %s for %s %s", ErrSchalterInterlock, powerItem, motor.direction, motor.owner.Type, motor.owner.Id)
+		}
+
+		//the running command is superseded, its turn-off timer must not fire
+		if motor.timer != nil {
+			motor.timer.Stop()
+		}
+		motor.gen++
+		if motor.done != nil {
+			go motor.done(false)
+		}
+		motor.timer = nil
+		motor.done = nil
+
+		if motor.direction != direction {
+			err := stopMotor(directionItem, powerItem)
+			motor.last = motor.direction
+			motor.direction = ""
+			motor.stopped = time.Now()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//never reverse a motor before the dead time has passed
+	if motor.last != "" && motor.last != direction {
+		if wait := motorDeadTime() - time.Since(motor.stopped); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	_, err := SendSchalterCommand(directionItem, direction)
+	if err == nil {
+		_, err = SendSchalterCommand(powerItem, "ON")
+	}
+	if err != nil {
+		//leave the motor stopped if it could not be driven
+		stopMotor(directionItem, powerItem)
+		motor.last = direction
+		motor.direction = ""
+		motor.stopped = time.Now()
+		return fmt.Errorf("error querying schalter: %s", err)
+	}
+
+	motor.gen++
+	gen := motor.gen
+	motor.direction = direction
+	motor.owner = owner
+	motor.done = done
+	motor.timer = time.AfterFunc(runTime, func() {
+		motor.mu.Lock()
+		if motor.gen != gen {
+			motor.mu.Unlock()
+			return
+		}
+		err := stopMotor(directionItem, powerItem)
+		if err != nil {
+			log.Printf(Red+"error querying Schalter: %s\n"+Reset, err)
+		}
+		done := motor.done
+		motor.last = motor.direction
+		motor.direction = ""
+		motor.stopped = time.Now()
+		motor.timer = nil
+		motor.done = nil
+		motor.mu.Unlock()
+
+		if done != nil {
+			done(true)
+		}
+	})
+
+	return nil
+}
+
+func stopMotor(directionItem string, powerItem string) error {
+	//power goes off first so the motor never runs against a switching relay
+	_, err := SendSchalterCommand(powerItem, "OFF")
+	if err != nil {
+		return fmt.Errorf("error querying schalter: %s", err)
+	}
+	_, err = SendSchalterCommand(directionItem, "OFF")
+	if err != nil {
+		return fmt.Errorf("error querying schalter: %s", err)
+	}
+	return nil
+}
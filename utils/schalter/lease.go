@@ -0,0 +1,197 @@
+package schalter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+// leases replace the old locked countdown, expiry is stored as an absolute
+// timestamp (unix milliseconds) so a lock survives a restart
+var leases = make(map[string]SchalterLease)
+var leasesMu sync.Mutex
+
+func CreateLeaseTable() error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("createLeaseTable: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.SchalterLeases (name VARCHAR(255) NOT NULL PRIMARY KEY, ownerType VARCHAR(32) NOT NULL, ownerId VARCHAR(255) NOT NULL, expires BIGINT NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("createLeaseTable: %s", err)
+	}
+
+	return nil
+}
+
+func LoadLeases() error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("loadLeases: %s", err)
+	}
+	defer db.Close()
+
+	//drop leases that expired while the server was down
+	_, err = db.Exec("DELETE FROM sys.SchalterLeases WHERE expires <= ?", time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("loadLeases: %s", err)
+	}
+
+	rows, err := db.Query("SELECT name, ownerType, ownerId, expires FROM sys.SchalterLeases")
+	if err != nil {
+		return fmt.Errorf("loadLeases: %s", err)
+	}
+	defer rows.Close()
+
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+	for rows.Next() {
+		var lease SchalterLease
+		var expires int64
+		err := rows.Scan(&lease.Name, &lease.Owner.Type, &lease.Owner.Id, &expires)
+		if err != nil {
+			return fmt.Errorf("loadLeases: %s", err)
+		}
+		lease.Expires = time.UnixMilli(expires)
+		leases[lease.Name] = lease
+	}
+
+	return nil
+}
+
+func GetLease(name string) (SchalterLease, bool) {
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+
+	lease, ok := leases[name]
+	if !ok {
+		return SchalterLease{}, false
+	}
+	if !time.Now().Before(lease.Expires) {
+		//expired rows are overwritten on the next acquire or dropped on startup
+		delete(leases, name)
+		return SchalterLease{}, false
+	}
+	return lease, true
+}
+
+func AcquireLease(name string, owner SchalterSource, duration time.Duration) error {
+	//lock a Schalter for owner, the same owner may extend its own lease and
+	//a higher priority takes over the lease of a lower one
+	leasesMu.Lock()
+	lease, ok := leases[name]
+	active := ok && time.Now().Before(lease.Expires) && lease.Owner != owner
+	if active && !CanPreempt(owner, lease.Owner) {
+		leasesMu.Unlock()
+		return ErrSchalterLocked
+	}
+	previous := lease
+	lease = SchalterLease{Name: name, Owner: owner, Expires: time.Now().Add(duration)}
+	leases[name] = lease
+	leasesMu.Unlock()
+
+	err := saveLease(lease)
+	if err != nil {
+		//the lease never took effect, give the Schalter back unless it changed since
+		leasesMu.Lock()
+		if current, found := leases[name]; found && current == lease {
+			if ok {
+				leases[name] = previous
+			} else {
+				delete(leases, name)
+			}
+		}
+		leasesMu.Unlock()
+		return err
+	}
+	if active {
+		notifyPreempted(name, previous.Owner, owner)
+	}
+	PublishSchalterEvent(EventLock, name)
+
+	//tell subscribers when the lease runs out without being released
+	time.AfterFunc(duration, func() {
+		if _, ok := GetLease(name); !ok {
+			PublishSchalterEvent(EventLock, name)
+		}
+	})
+	return nil
+}
+
+func ReleaseLease(name string, owner SchalterSource) error {
+	//unlock a Schalter, only the owner can release its lease
+	leasesMu.Lock()
+	lease, ok := leases[name]
+	if !ok || lease.Owner != owner {
+		leasesMu.Unlock()
+		return nil
+	}
+	delete(leases, name)
+	leasesMu.Unlock()
+
+	err := deleteLease(name)
+	if err != nil {
+		return err
+	}
+	PublishSchalterEvent(EventLock, name)
+	return nil
+}
+
+func applyLease(status *SchalterStatus) {
+	//fill lock fields of status from the lease manager
+	lease, ok := GetLease(status.Name)
+	if !ok {
+		status.Locked = 0
+		status.LockOwner = nil
+		status.LockedUntil = nil
+		status.ControlledBy = nil
+		status.Priority = 0
+		return
+	}
+	owner := lease.Owner
+	expires := lease.Expires
+	status.Locked = int(time.Until(expires).Seconds()) + 1
+	status.LockOwner = &owner
+	status.LockedUntil = &expires
+	status.ControlledBy = &owner
+	status.Priority = SourcePriority(owner.Type)
+}
+
+func saveLease(lease SchalterLease) error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("saveLease: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO sys.SchalterLeases (name, ownerType, ownerId, expires) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE ownerType = VALUES(ownerType), ownerId = VALUES(ownerId), expires = VALUES(expires)", lease.Name, lease.Owner.Type, lease.Owner.Id, lease.Expires.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("saveLease: %s", err)
+	}
+
+	return nil
+}
+
+func deleteLease(name string) error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("deleteLease: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM sys.SchalterLeases WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("deleteLease: %s", err)
+	}
+
+	return nil
+}
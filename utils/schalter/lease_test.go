@@ -0,0 +1,45 @@
+package schalter
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+)
+
+func TestAcquireLeaseKeepsPreviousOnSaveError(t *testing.T) {
+	if os.Getenv("DB_IP") != "" {
+		t.Skip("needs saving the lease to fail")
+	}
+	//nothing listens for mysql here, so every save fails
+	t.Setenv("DB_IP", "127.0.0.1")
+
+	leasesMu.Lock()
+	saved := leases
+	leases = make(map[string]SchalterLease)
+	leasesMu.Unlock()
+	t.Cleanup(func() {
+		leasesMu.Lock()
+		leases = saved
+		leasesMu.Unlock()
+	})
+
+	if err := AcquireLease("Flur", SchalterSource{Type: SourceUser, Id: "anna"}, time.Minute); err == nil {
+		t.Fatal("no error for a lease that was not saved")
+	}
+	if lease, ok := GetLease("Flur"); ok {
+		t.Errorf("got lease %+v for a failed acquire", lease)
+	}
+
+	previous := SchalterLease{Name: "Flur", Owner: SchalterSource{Type: SourceScript, Id: "abend"}, Expires: time.Now().Add(time.Minute)}
+	leasesMu.Lock()
+	leases["Flur"] = previous
+	leasesMu.Unlock()
+	if err := AcquireLease("Flur", SchalterSource{Type: SourceUser, Id: "anna"}, time.Minute); err == nil {
+		t.Fatal("no error for a lease that was not saved")
+	}
+	if lease, ok := GetLease("Flur"); !ok || lease != previous {
+		t.Errorf("got lease %+v, want %+v", lease, previous)
+	}
+}
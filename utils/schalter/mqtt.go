@@ -0,0 +1,431 @@
+package schalter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Tasmota style topics, Shelly devices set their own templates
+var defaultMqttCommandTopic = "cmnd/{device}/POWER"
+var defaultMqttStateTopic = "stat/{device}/POWER"
+
+var mqttClient mqtt.Client
+var mqttDevices = make(map[string]MqttDevice)
+var mqttMu sync.Mutex
+
+func CreateMqttTable() error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("createMqttTable: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.SchalterMqtt (name VARCHAR(255) NOT NULL PRIMARY KEY, device VARCHAR(255) NOT NULL, commandTopic VARCHAR(255) NOT NULL DEFAULT '', stateTopic VARCHAR(255) NOT NULL DEFAULT '', payloadOn VARCHAR(64) NOT NULL DEFAULT 'ON', payloadOff VARCHAR(64) NOT NULL DEFAULT 'OFF')")
+	if err != nil {
+		return fmt.Errorf("createMqttTable: %s", err)
+	}
+
+	return nil
+}
+
+func StartMqtt() error {
+	//connect to MQTT_BROKER and follow the state of all MQTT devices, no broker disables MQTT
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		return nil
+	}
+
+	err := loadMqttDevices()
+	if err != nil {
+		return fmt.Errorf("startMqtt: %s", err)
+	}
+	return connectMqtt(broker)
+}
+
+func connectMqtt(broker string) error {
+	//connect to broker and subscribe the state topics of the loaded devices
+	clientId, err := RandomHex(4)
+	if err != nil {
+		return fmt.Errorf("startMqtt: %s", err)
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID("server-" + clientId)
+	opts.SetUsername(os.Getenv("MQTT_USERNAME"))
+	opts.SetPassword(os.Getenv("MQTT_PASSWORD"))
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetMaxReconnectInterval(1 * time.Minute)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		//subscriptions are lost with the connection
+		mqttMu.Lock()
+		devices := make([]MqttDevice, 0, len(mqttDevices))
+		for _, device := range mqttDevices {
+			devices = append(devices, device)
+		}
+		mqttMu.Unlock()
+
+		for _, device := range devices {
+			subscribeMqttDevice(client, device)
+		}
+		log.Printf(Green+"mqtt connected to %s\n"+Reset, broker)
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		log.Printf(Red+"mqtt connection lost: %s\n"+Reset, err)
+	})
+
+	mqttMu.Lock()
+	mqttClient = mqtt.NewClient(opts)
+	client := mqttClient
+	mqttMu.Unlock()
+
+	//with connect retry the token only fails for a broken configuration
+	token := client.Connect()
+	go func() {
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf(Red+"mqtt: %s\n"+Reset, token.Error())
+		}
+	}()
+
+	return nil
+}
+
+func loadMqttDevices() error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("loadMqttDevices: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name, device, commandTopic, stateTopic, payloadOn, payloadOff FROM sys.SchalterMqtt")
+	if err != nil {
+		return fmt.Errorf("loadMqttDevices: %s", err)
+	}
+	defer rows.Close()
+
+	mqttMu.Lock()
+	defer mqttMu.Unlock()
+	for rows.Next() {
+		var device MqttDevice
+		err := rows.Scan(&device.Name, &device.Device, &device.CommandTopic, &device.StateTopic, &device.PayloadOn, &device.PayloadOff)
+		if err != nil {
+			return fmt.Errorf("loadMqttDevices: %s", err)
+		}
+		mqttDevices[device.Name] = resolveMqttTopics(device)
+	}
+
+	return nil
+}
+
+func GetMqttDeviceNames() (map[string]bool, error) {
+	//names of all registered MQTT devices, also without a configured broker
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return nil, fmt.Errorf("getMqttDeviceNames: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name FROM sys.SchalterMqtt")
+	if err != nil {
+		return nil, fmt.Errorf("getMqttDeviceNames: %s", err)
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("getMqttDeviceNames: %s", err)
+		}
+		names[name] = true
+	}
+	return names, nil
+}
+
+func resolveMqttTopics(device MqttDevice) MqttDevice {
+	//topic templates may contain {device} and {name}
+	if device.CommandTopic == "" {
+		device.CommandTopic = os.Getenv("MQTT_COMMAND_TOPIC")
+	}
+	if device.CommandTopic == "" {
+		device.CommandTopic = defaultMqttCommandTopic
+	}
+	if device.StateTopic == "" {
+		device.StateTopic = os.Getenv("MQTT_STATE_TOPIC")
+	}
+	if device.StateTopic == "" {
+		device.StateTopic = defaultMqttStateTopic
+	}
+	if device.PayloadOn == "" {
+		device.PayloadOn = "ON"
+	}
+	if device.PayloadOff == "" {
+		device.PayloadOff = "OFF"
+	}
+
+	replacer := strings.NewReplacer("{device}", device.Device, "{name}", device.Name)
+	device.CommandTopic = replacer.Replace(device.CommandTopic)
+	device.StateTopic = replacer.Replace(device.StateTopic)
+	return device
+}
+
+func subscribeMqttDevice(client mqtt.Client, device MqttDevice) {
+	token := client.Subscribe(device.StateTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		handleMqttState(device, msg.Payload())
+	})
+	go func() {
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf(Red+"mqtt: error subscribing %s: %s\n"+Reset, device.StateTopic, token.Error())
+		}
+	}()
+}
+
+func GetMqttDevice(name string) (MqttDevice, bool) {
+	mqttMu.Lock()
+	defer mqttMu.Unlock()
+
+	device, ok := mqttDevices[name]
+	return device, ok
+}
+
+func MqttConnected() bool {
+	mqttMu.Lock()
+	defer mqttMu.Unlock()
+
+	return mqttClient != nil && mqttClient.IsConnectionOpen()
+}
+
+func PublishMqttCommand(device MqttDevice, state string) error {
+	//send a command to the command topic of device
+	mqttMu.Lock()
+	client := mqttClient
+	mqttMu.Unlock()
+	if client == nil {
+		return errors.New("mqtt: no broker configured")
+	}
+
+	payload := state
+	switch state {
+	case "ON":
+		payload = device.PayloadOn
+	case "OFF":
+		payload = device.PayloadOff
+	}
+
+	token := client.Publish(device.CommandTopic, 1, false, payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("mqtt: timeout publishing to %s", device.CommandTopic)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("mqtt: %s", token.Error())
+	}
+	return nil
+}
+
+func mqttPayloadState(device MqttDevice, payload []byte) string {
+	//plain payloads or tasmota/shelly json like {"POWER":"ON"} or {"ison":true}
+	raw := strings.TrimSpace(string(payload))
+	var t map[string]interface{}
+	if json.Unmarshal(payload, &t) == nil {
+		for _, key := range []string{"POWER", "state", "ison", "output"} {
+			value, ok := t[key]
+			if !ok {
+				continue
+			}
+			switch value := value.(type) {
+			case string:
+				raw = value
+			case bool:
+				raw = device.PayloadOff
+				if value {
+					raw = device.PayloadOn
+				}
+			case float64:
+				raw = formatNumber(value)
+			default:
+				continue
+			}
+			break
+		}
+	}
+
+	switch {
+	case strings.EqualFold(raw, device.PayloadOn):
+		return "ON"
+	case strings.EqualFold(raw, device.PayloadOff):
+		return "OFF"
+	}
+	return raw
+}
+
+func handleMqttState(device MqttDevice, payload []byte) {
+	state := mqttPayloadState(device, payload)
+
+	//confirm queued commands for this device
+	AckSchalterCommand(device.Name, state)
+
+	status, err := GetSchalterStatus(device.Name)
+	if err != nil {
+		log.Printf(Red+"error syncing mqtt schalter data: %s\n"+Reset, err)
+		return
+	}
+
+	//the owner of a running command stores the state itself
+	hardware := SchalterSource{Type: SourceHardware, Id: device.Name}
+	if status.LockOwner != nil && *status.LockOwner != hardware {
+		return
+	}
+	if status.State == state {
+		return
+	}
+	err = UpdateSchalterStatus(SchalterStatus{Name: device.Name, State: state}, hardware)
+	if err != nil {
+		log.Printf(Red+"error updating schalter status: %s\n"+Reset, err)
+	}
+}
+
+func SetMqttDevice(device MqttDevice, deviceType string) error {
+	//register an MQTT device, it shows up in sys.Schalter like an openHAB item
+	if deviceType == "" {
+		deviceType = TypeSwitch
+	}
+	if deviceType == TypeShutter {
+		return fmt.Errorf("%w: mqtt devices can not be shutters", ErrSchalterValue)
+	}
+	err := SetSchalterType(device.Name, deviceType)
+	if err != nil {
+		return err
+	}
+
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("setMqttDevice: %s", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("setMqttDevice: %s", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO sys.SchalterMqtt (name, device, commandTopic, stateTopic, payloadOn, payloadOff) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE device = VALUES(device), commandTopic = VALUES(commandTopic), stateTopic = VALUES(stateTopic), payloadOn = VALUES(payloadOn), payloadOff = VALUES(payloadOff)", device.Name, device.Device, device.CommandTopic, device.StateTopic, device.PayloadOn, device.PayloadOff)
+	if err != nil {
+		return fmt.Errorf("setMqttDevice: %s", err)
+	}
+	_, err = tx.Exec("INSERT IGNORE INTO sys.Schalter (name, state, widgetId, scriptState) VALUES (?, 'OFF', ?, false)", device.Name, "mqtt-"+device.Device)
+	if err != nil {
+		return fmt.Errorf("setMqttDevice: %s", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("setMqttDevice: %s", err)
+	}
+
+	device = resolveMqttTopics(device)
+	mqttMu.Lock()
+	old, existed := mqttDevices[device.Name]
+	mqttDevices[device.Name] = device
+	client := mqttClient
+	mqttMu.Unlock()
+
+	if client != nil && client.IsConnectionOpen() {
+		if existed && old.StateTopic != device.StateTopic {
+			client.Unsubscribe(old.StateTopic)
+		}
+		subscribeMqttDevice(client, device)
+	}
+
+	return nil
+}
+
+func SchalterMqtt(w http.ResponseWriter, r *http.Request) {
+	//list and register MQTT devices with session token
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		mqttMu.Lock()
+		devices := make([]MqttDevice, 0, len(mqttDevices))
+		for _, device := range mqttDevices {
+			devices = append(devices, device)
+		}
+		mqttMu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"connected": MqttConnected(), "devices": devices})
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//check if name and device are valid
+		var device MqttDevice
+		device.Name, _ = t["name"].(string)
+		device.Device, _ = t["device"].(string)
+		if device.Name == "" || device.Device == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no name or device"))
+			return
+		}
+		device.CommandTopic, _ = t["commandTopic"].(string)
+		device.StateTopic, _ = t["stateTopic"].(string)
+		device.PayloadOn, _ = t["payloadOn"].(string)
+		device.PayloadOff, _ = t["payloadOff"].(string)
+		deviceType, _ := t["type"].(string)
+
+		err = SetMqttDevice(device, deviceType)
+		if errors.Is(err, ErrSchalterValue) {
+			SendError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error setting mqtt device: %s", err))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	default:
+		log.Printf(Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}
@@ -0,0 +1,210 @@
+package schalter
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+
+	_ "github.com/go-sql-driver/mysql"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+type mqttMessage struct {
+	topic   string
+	payload string
+}
+
+func startTestBroker(t *testing.T, devices ...MqttDevice) *broker.Server {
+	//in-process broker on a free port, the package client connects to it
+	t.Helper()
+
+	server := broker.New(&broker.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	err := server.AddHook(new(auth.AllowHook), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	err = server.AddListener(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	mqttMu.Lock()
+	mqttDevices = make(map[string]MqttDevice)
+	for _, device := range devices {
+		device = resolveMqttTopics(device)
+		mqttDevices[device.Name] = device
+	}
+	mqttMu.Unlock()
+
+	err = connectMqtt("tcp://" + tcp.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		mqttMu.Lock()
+		client := mqttClient
+		mqttClient = nil
+		mqttDevices = make(map[string]MqttDevice)
+		mqttMu.Unlock()
+		if client != nil {
+			client.Disconnect(100)
+		}
+		server.Close()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !MqttConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("mqtt client did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return server
+}
+
+func subscribeTestBroker(t *testing.T, server *broker.Server, filter string) chan mqttMessage {
+	t.Helper()
+
+	messages := make(chan mqttMessage, 16)
+	err := server.Subscribe(filter, 1, func(cl *broker.Client, sub packets.Subscription, pk packets.Packet) {
+		messages <- mqttMessage{topic: pk.TopicName, payload: string(pk.Payload)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func receiveMessage(t *testing.T, messages chan mqttMessage) mqttMessage {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message from broker")
+	}
+	return mqttMessage{}
+}
+
+func TestMqttCommandTopics(t *testing.T) {
+	t.Setenv("MQTT_COMMAND_TOPIC", "home/{device}/set")
+	t.Setenv("MQTT_STATE_TOPIC", "home/{device}/state")
+
+	templated := MqttDevice{Name: "Steckdose", Device: "plug1", PayloadOn: "1", PayloadOff: "0"}
+	custom := MqttDevice{Name: "Pumpe", Device: "shelly1", CommandTopic: "shellies/{device}/relay/0/command", StateTopic: "shellies/{device}/relay/0", PayloadOn: "on", PayloadOff: "off"}
+	server := startTestBroker(t, templated, custom)
+	messages := subscribeTestBroker(t, server, "#")
+
+	tests := []struct {
+		device  string
+		state   string
+		topic   string
+		payload string
+	}{
+		{"Steckdose", "ON", "home/plug1/set", "1"},
+		{"Steckdose", "OFF", "home/plug1/set", "0"},
+		{"Pumpe", "ON", "shellies/shelly1/relay/0/command", "on"},
+		{"Pumpe", "50", "shellies/shelly1/relay/0/command", "50"},
+	}
+	for _, test := range tests {
+		device, ok := GetMqttDevice(test.device)
+		if !ok {
+			t.Fatalf("device %s not loaded", test.device)
+		}
+		err := PublishMqttCommand(device, test.state)
+		if err != nil {
+			t.Fatalf("%s %s: %s", test.device, test.state, err)
+		}
+
+		message := receiveMessage(t, messages)
+		if message.topic != test.topic || message.payload != test.payload {
+			t.Errorf("%s %s: got %s %q, want %s %q", test.device, test.state, message.topic, message.payload, test.topic, test.payload)
+		}
+	}
+}
+
+func TestMqttStateConfirmsCommand(t *testing.T) {
+	//the device answers every command on its state topic like tasmota does
+	device := MqttDevice{Name: "Steckdose", Device: "plug1"}
+	server := startTestBroker(t, device)
+	device, _ = GetMqttDevice(device.Name)
+
+	commands := subscribeTestBroker(t, server, device.CommandTopic)
+	go func() {
+		for command := range commands {
+			server.Publish(device.StateTopic, []byte(`{"POWER":"`+command.payload+`"}`), false, 0)
+		}
+	}()
+
+	entry, err := SendSchalterCommand(device.Name, "ON")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != CommandAcked {
+		t.Errorf("got status %s, want %s", entry.Status, CommandAcked)
+	}
+}
+
+func TestMqttStateUpdatesStatus(t *testing.T) {
+	//the stored state lives in sys.Schalter, so this needs the database
+	if os.Getenv("DB_IP") == "" {
+		t.Skip("DB_IP not set")
+	}
+	for _, create := range []func() error{CreateMqttTable, CreateSchalterTypeTable} {
+		err := create()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := startTestBroker(t)
+	device := MqttDevice{Name: "TestMqttSteckdose", Device: "testplug"}
+	err := SetMqttDevice(device, TypeSwitch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db, err := DBConnection()
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		for _, table := range []string{"sys.SchalterMqtt", "sys.SchalterTypes", "sys.Schalter"} {
+			db.Exec("DELETE FROM "+table+" WHERE name = ?", device.Name)
+		}
+	})
+	device, _ = GetMqttDevice(device.Name)
+
+	//the subscription is set up asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		server.Publish(device.StateTopic, []byte("ON"), false, 0)
+		time.Sleep(100 * time.Millisecond)
+
+		status, err := GetSchalterStatus(device.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State == "ON" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got state %s, want ON", status.State)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package schalter
+
+import (
+	"log"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+)
+
+// higher priorities take over the lease of lower ones, equal priorities wait
+// until the lease runs out or is released
+var sourcePriorities = map[string]int{
+	SourceSafety:   4,
+	SourceUser:     3,
+	SourceHardware: 3,
+	SourceScript:   2,
+	SourceSchedule: 1,
+}
+
+func SourcePriority(sourceType string) int {
+	return sourcePriorities[sourceType]
+}
+
+func CanPreempt(owner SchalterSource, current SchalterSource) bool {
+	//true if owner may take a Schalter over from current
+	return SourcePriority(owner.Type) > SourcePriority(current.Type)
+}
+
+func notifyPreempted(name string, preempted SchalterSource, by SchalterSource) {
+	//the lower source learns from the event stream that it lost control
+	log.Printf(Yellow+"schalter %s: %s %s preempted by %s %s\n"+Reset, name, preempted.Type, preempted.Id, by.Type, by.Id)
+	publishSchalterEvent(EventPreempt, &preempted, name)
+}
+
+func Preempted(name string, owner SchalterSource) bool {
+	//true if a source owner can not preempt controls the Schalter
+	lease, ok := GetLease(name)
+	return ok && lease.Owner != owner && !CanPreempt(owner, lease.Owner)
+}
+
+func WaitForControl(name string, owner SchalterSource, stopped func() bool) bool {
+	//pause until owner may control the Schalter again, false if stopped
+	//returned true first
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if stopped != nil && stopped() {
+			return false
+		}
+		if !Preempted(name, owner) {
+			return true
+		}
+	}
+	return false
+}
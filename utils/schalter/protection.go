@@ -0,0 +1,468 @@
+package schalter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	klingel "github.com/GineHyte/server/utils/klingel"
+	query "github.com/GineHyte/server/utils/query"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+// state of every protection rule by rule name
+var protectionStates = make(map[string]*ProtectionStatus)
+
+// states blocked by frost rules, by shutter and rule name
+var frostBlocks = make(map[string]map[string]string)
+var protectionMu sync.Mutex
+
+func CreateProtectionTable() error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("createProtectionTable: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.SchalterProtection (name VARCHAR(255) NOT NULL PRIMARY KEY, kind VARCHAR(32) NOT NULL, query TEXT NOT NULL, threshold DOUBLE NOT NULL, target VARCHAR(255) NOT NULL DEFAULT '', state VARCHAR(32) NOT NULL, hold INT NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("createProtectionTable: %s", err)
+	}
+
+	return nil
+}
+
+func GetProtectionRules() ([]ProtectionRule, error) {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return []ProtectionRule{}, fmt.Errorf("getProtectionRules: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name, kind, query, threshold, target, state, hold FROM sys.SchalterProtection ORDER BY name")
+	if err != nil {
+		return []ProtectionRule{}, fmt.Errorf("getProtectionRules: %s", err)
+	}
+	defer rows.Close()
+
+	rules := make([]ProtectionRule, 0)
+	for rows.Next() {
+		var rule ProtectionRule
+		err := rows.Scan(&rule.Name, &rule.Kind, &rule.Query, &rule.Threshold, &rule.Target, &rule.State, &rule.Hold)
+		if err != nil {
+			return []ProtectionRule{}, fmt.Errorf("getProtectionRules: %s", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func SetProtectionRule(rule ProtectionRule) error {
+	switch rule.Kind {
+	case ProtectionWind, ProtectionRain, ProtectionFrost:
+	default:
+		return fmt.Errorf("%w: unknown protection kind %s", ErrSchalterValue, rule.Kind)
+	}
+	if rule.Query == "" {
+		return fmt.Errorf("%w: no query", ErrSchalterValue)
+	}
+	rule.State = strings.ToUpper(rule.State)
+	if rule.State != "ON" && rule.State != "OFF" {
+		return fmt.Errorf("%w: state must be ON or OFF", ErrSchalterValue)
+	}
+	if rule.Hold <= 0 {
+		rule.Hold = 900
+	}
+
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("setProtectionRule: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO sys.SchalterProtection (name, kind, query, threshold, target, state, hold) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE kind = VALUES(kind), query = VALUES(query), threshold = VALUES(threshold), target = VALUES(target), state = VALUES(state), hold = VALUES(hold)", rule.Name, rule.Kind, rule.Query, rule.Threshold, rule.Target, rule.State, rule.Hold)
+	if err != nil {
+		return fmt.Errorf("setProtectionRule: %s", err)
+	}
+
+	return nil
+}
+
+func DeleteProtectionRule(name string) error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("deleteProtectionRule: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM sys.SchalterProtection WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("deleteProtectionRule: %s", err)
+	}
+
+	//a deleted rule gives its shutters back
+	protectionMu.Lock()
+	state, ok := protectionStates[name]
+	delete(protectionStates, name)
+	protectionMu.Unlock()
+	if ok && state.Active {
+		deactivateProtection(state.Rule, state.Shutters, "rule deleted")
+	}
+
+	return nil
+}
+
+func protectionInterval() time.Duration {
+	interval, err := strconv.Atoi(os.Getenv("PROTECTION_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(interval) * time.Second
+}
+
+func ProtectionJob() {
+	//check every protection rule against the weather station data
+	for {
+		rules, err := GetProtectionRules()
+		if err != nil {
+			log.Printf(Red+"error getting protection rules: %s\n"+Reset, err)
+		}
+		for _, rule := range rules {
+			checkProtectionRule(rule)
+		}
+		time.Sleep(protectionInterval())
+	}
+}
+
+func checkProtectionRule(rule ProtectionRule) {
+	protectionMu.Lock()
+	state, ok := protectionStates[rule.Name]
+	if !ok {
+		state = &ProtectionStatus{Shutters: make([]string, 0)}
+		protectionStates[rule.Name] = state
+	}
+	state.Rule = rule
+	wasActive := state.Active
+	protectionMu.Unlock()
+
+	now := time.Now()
+	value, err := latestInfluxValue(rule.Query)
+
+	protectionMu.Lock()
+	state.Checked = &now
+	if err != nil {
+		//without data an active rule keeps holding its shutters
+		state.LastError = err.Error()
+		shutters := state.Shutters
+		protectionMu.Unlock()
+		log.Printf(Red+"protection %s: %s\n"+Reset, rule.Name, err)
+		if wasActive {
+			applyProtection(rule, shutters, false)
+		}
+		return
+	}
+	state.LastError = ""
+	state.Value = &value
+	protectionMu.Unlock()
+
+	triggered := value > rule.Threshold
+	if rule.Kind == ProtectionFrost {
+		triggered = value < rule.Threshold
+	}
+
+	if triggered {
+		shutters, err := protectionTargets(rule.Target)
+		if err != nil {
+			log.Printf(Red+"protection %s: %s\n"+Reset, rule.Name, err)
+			return
+		}
+		protectionMu.Lock()
+		state.Active = true
+		state.Clear = nil
+		state.Shutters = shutters
+		if !wasActive {
+			state.Since = &now
+		}
+		protectionMu.Unlock()
+
+		if !wasActive {
+			notifyProtection(rule, fmt.Sprintf("%s protection %s active: %s is %s (threshold %s), holding %s", rule.Kind, rule.Name, rule.Query, formatNumber(value), formatNumber(rule.Threshold), strings.Join(shutters, ", ")))
+		}
+		applyProtection(rule, shutters, !wasActive)
+		return
+	}
+
+	if !wasActive {
+		return
+	}
+
+	//release only after the condition stayed clear for the hold time
+	protectionMu.Lock()
+	if state.Clear == nil {
+		state.Clear = &now
+	}
+	clearSince := *state.Clear
+	shutters := state.Shutters
+	protectionMu.Unlock()
+
+	if time.Since(clearSince) < time.Duration(rule.Hold)*time.Second {
+		applyProtection(rule, shutters, false)
+		return
+	}
+
+	protectionMu.Lock()
+	state.Active = false
+	state.Clear = nil
+	state.Since = &now
+	state.Shutters = make([]string, 0)
+	protectionMu.Unlock()
+	deactivateProtection(rule, shutters, fmt.Sprintf("%s is %s", rule.Query, formatNumber(value)))
+}
+
+func latestInfluxValue(fluxQuery string) (float64, error) {
+	//last value of the first table of the query result
+	resp, err := query.QueryInfluxDBWithToken(os.Getenv("ADMIN_TOKEN"), fluxQuery)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.LineSets) == 0 || len(resp.LineSets[0]) == 0 {
+		return 0, errors.New("no data")
+	}
+	return resp.LineSets[0][len(resp.LineSets[0])-1].Value, nil
+}
+
+func protectionTargets(target string) ([]string, error) {
+	//"group:<name>", "room:<name>", "floor:<name>" or all shutters
+	var group, room, floor string
+	kind, value, _ := strings.Cut(target, ":")
+	switch kind {
+	case "group":
+		group = value
+	case "room":
+		room = value
+	case "floor":
+		floor = value
+	case "":
+	default:
+		return []string{}, fmt.Errorf("unknown target %s", target)
+	}
+
+	members, err := GetSchalterGroupMembers(group, room, floor)
+	if err != nil {
+		return []string{}, err
+	}
+	shutters := make([]string, 0)
+	for _, member := range members {
+		if member.Type == TypeShutter {
+			shutters = append(shutters, member.Name)
+		}
+	}
+	sort.Strings(shutters)
+	return shutters, nil
+}
+
+func applyProtection(rule ProtectionRule, shutters []string, activated bool) {
+	owner := SchalterSource{Type: SourceSafety, Id: rule.Name}
+
+	//frost only blocks the state that would move frozen shutters
+	if rule.Kind == ProtectionFrost {
+		protectionMu.Lock()
+		for _, shutter := range shutters {
+			if frostBlocks[shutter] == nil {
+				frostBlocks[shutter] = make(map[string]string)
+			}
+			frostBlocks[shutter][rule.Name] = rule.State
+		}
+		protectionMu.Unlock()
+		return
+	}
+
+	//the lease outlives the next check, it runs out if the server stops checking
+	leaseTime := 3 * protectionInterval()
+	for _, shutter := range shutters {
+		err := AcquireLease(shutter, owner, leaseTime)
+		if err != nil {
+			log.Printf(Red+"protection %s: error locking %s: %s\n"+Reset, rule.Name, shutter, err)
+			continue
+		}
+		err = RunSchalterCommand(SchalterStatus{Name: shutter, State: rule.State, Locked: int(leaseTime.Seconds())}, owner)
+		if err != nil && !errors.Is(err, ErrSchalterAlreadySet) {
+			log.Printf(Red+"protection %s: error moving %s: %s\n"+Reset, rule.Name, shutter, err)
+			continue
+		}
+		if activated && err == nil {
+			log.Printf(Yellow+"protection %s: moved %s to %s\n"+Reset, rule.Name, shutter, rule.State)
+		}
+	}
+}
+
+func deactivateProtection(rule ProtectionRule, shutters []string, reason string) {
+	owner := SchalterSource{Type: SourceSafety, Id: rule.Name}
+
+	protectionMu.Lock()
+	for _, shutter := range shutters {
+		delete(frostBlocks[shutter], rule.Name)
+		if len(frostBlocks[shutter]) == 0 {
+			delete(frostBlocks, shutter)
+		}
+	}
+	protectionMu.Unlock()
+
+	for _, shutter := range shutters {
+		err := ReleaseLease(shutter, owner)
+		if err != nil {
+			log.Printf(Red+"protection %s: error unlocking %s: %s\n"+Reset, rule.Name, shutter, err)
+		}
+	}
+	notifyProtection(rule, fmt.Sprintf("%s protection %s released: %s", rule.Kind, rule.Name, reason))
+}
+
+func frostBlocked(name string, state string) (string, bool) {
+	//name of the frost rule blocking state for the shutter name
+	protectionMu.Lock()
+	defer protectionMu.Unlock()
+
+	for rule, blocked := range frostBlocks[name] {
+		if blocked == state {
+			return rule, true
+		}
+	}
+	return "", false
+}
+
+func notifyProtection(rule ProtectionRule, message string) {
+	//every intervention is logged and mailed to PROTECTION_MAIL_TO
+	log.Printf(Yellow+"%s\n"+Reset, message)
+
+	to := os.Getenv("PROTECTION_MAIL_TO")
+	if to == "" {
+		return
+	}
+	go func() {
+		err := klingel.SendMail(os.Getenv("MAIL_FROM"), to, "Schalter "+rule.Kind+" protection", message, "")
+		if err != nil {
+			log.Printf(Red+"error sending protection mail: %s\n"+Reset, err)
+		}
+	}()
+}
+
+func GetProtectionStatuses() ([]ProtectionStatus, error) {
+	rules, err := GetProtectionRules()
+	if err != nil {
+		return []ProtectionStatus{}, err
+	}
+
+	protectionMu.Lock()
+	defer protectionMu.Unlock()
+
+	statuses := make([]ProtectionStatus, 0, len(rules))
+	for _, rule := range rules {
+		status := ProtectionStatus{Rule: rule, Shutters: make([]string, 0)}
+		if state, ok := protectionStates[rule.Name]; ok {
+			status = *state
+			status.Rule = rule
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func SchalterProtection(w http.ResponseWriter, r *http.Request) {
+	//list protection rules and their state, change them as admin
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		statuses, err := GetProtectionStatuses()
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting protection rules: %s", err))
+			return
+		}
+		json.NewEncoder(w).Encode(statuses)
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//only admins change safety rules
+		is_admin, err := IsAdmin(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking admin: %s", err))
+			return
+		}
+		if !is_admin {
+			SendError(w, http.StatusForbidden, errors.New("admin rights required"))
+			return
+		}
+
+		//check if name is valid
+		var rule ProtectionRule
+		rule.Name, _ = t["name"].(string)
+		if rule.Name == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no name"))
+			return
+		}
+
+		if remove, _ := t["delete"].(bool); remove {
+			err = DeleteProtectionRule(rule.Name)
+		} else {
+			rule.Kind, _ = t["kind"].(string)
+			rule.Query, _ = t["query"].(string)
+			rule.Threshold, _ = t["threshold"].(float64)
+			rule.Target, _ = t["target"].(string)
+			rule.State, _ = t["state"].(string)
+			hold, _ := t["hold"].(float64)
+			rule.Hold = int(hold)
+			err = SetProtectionRule(rule)
+		}
+		if errors.Is(err, ErrSchalterValue) {
+			SendError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error setting protection rule: %s", err))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	default:
+		log.Printf(Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}
@@ -0,0 +1,378 @@
+package schalter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+
+	"gopkg.in/cenkalti/backoff.v1"
+)
+
+var ErrSchalterCommandFailed = errors.New("schalter command failed")
+
+var commandAttempts = 3
+var commandWorkers = 4
+
+// a command waits in the queue until a worker sent it and the event stream
+// confirmed the new state
+type queuedCommand struct {
+	entry  SchalterCommandEntry
+	acked  chan bool
+	result chan error
+}
+
+var commandQueue = make(chan *queuedCommand, 64)
+var commandQueueOnce sync.Once
+
+var commandLog = make([]SchalterCommandEntry, 0)
+var commandLogSize = 256
+var commandId int64
+var commandsMu sync.Mutex
+
+// commands waiting for the event stream, by item name
+var pendingAcks = make(map[string][]*queuedCommand)
+var pendingAcksMu sync.Mutex
+
+func CreateCommandTable() error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("createCommandTable: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.SchalterCommands (id BIGINT NOT NULL PRIMARY KEY, item VARCHAR(255) NOT NULL, state VARCHAR(255) NOT NULL, status VARCHAR(32) NOT NULL, attempts INT NOT NULL, error TEXT, created BIGINT NOT NULL, updated BIGINT NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("createCommandTable: %s", err)
+	}
+
+	return nil
+}
+
+func startCommandQueue() {
+	//continue the ids of the last run
+	db, err := DBConnection()
+	if err == nil {
+		var lastId *int64
+		err = db.QueryRow("SELECT MAX(id) FROM sys.SchalterCommands").Scan(&lastId)
+		if err == nil && lastId != nil {
+			commandId = *lastId
+		}
+		db.Close()
+	}
+	if err != nil {
+		log.Printf(Red+"error reading last command id: %s\n"+Reset, err)
+	}
+
+	for i := 0; i < commandWorkers; i++ {
+		go commandWorker()
+	}
+}
+
+func SendSchalterCommand(item string, state string) (SchalterCommandEntry, error) {
+	//queue a command and wait until it was confirmed or failed
+	commandQueueOnce.Do(startCommandQueue)
+
+	commandsMu.Lock()
+	commandId++
+	now := time.Now()
+	command := &queuedCommand{
+		entry:  SchalterCommandEntry{Id: commandId, Item: item, State: state, Status: CommandPending, Created: now, Updated: now},
+		acked:  make(chan bool, 1),
+		result: make(chan error, 1),
+	}
+	commandsMu.Unlock()
+
+	recordCommand(command.entry, true)
+	commandQueue <- command
+
+	err := <-command.result
+	return GetSchalterCommand(command.entry.Id), err
+}
+
+func commandWorker() {
+	for command := range commandQueue {
+		command.result <- processCommand(command)
+	}
+}
+
+func processCommand(command *queuedCommand) error {
+	retry := backoff.NewExponentialBackOff()
+	retry.InitialInterval = 500 * time.Millisecond
+	retry.MaxElapsedTime = 0
+
+	var err error
+	for attempt := 1; attempt <= commandAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(retry.NextBackOff())
+		}
+		command.entry.Attempts = attempt
+
+		//listen before sending, the event may arrive before the response
+		device, isMqtt := GetMqttDevice(command.entry.Item)
+		confirm := !test && StreamConnected()
+		if isMqtt {
+			confirm = !test && MqttConnected()
+		}
+		//an item already in the target state sends no event, so nothing to wait for
+		alreadySet := false
+		if confirm {
+			state, err := currentItemState(command.entry.Item, isMqtt)
+			alreadySet = err == nil && commandMatchesState(command.entry.State, state)
+			if !alreadySet {
+				addPendingAck(command)
+			}
+		}
+
+		if isMqtt && !test {
+			err = PublishMqttCommand(device, command.entry.State)
+		} else {
+			err = SchalterControllFunc(command.entry.Item, command.entry.State)
+		}
+		if err != nil {
+			removePendingAck(command)
+			updateCommand(command, CommandPending, err)
+			continue
+		}
+
+		//without a connected event stream there is nothing that could confirm
+		if !confirm {
+			updateCommand(command, CommandUnconfirmed, nil)
+			return nil
+		}
+		if alreadySet {
+			updateCommand(command, CommandAcked, nil)
+			return nil
+		}
+		updateCommand(command, CommandSent, nil)
+
+		select {
+		case <-command.acked:
+			updateCommand(command, CommandAcked, nil)
+			return nil
+		case <-time.After(commandAckTimeout()):
+			removePendingAck(command)
+			//the event may have been lost, the item state still tells if it worked
+			if state, readErr := currentItemState(command.entry.Item, isMqtt); readErr == nil && commandMatchesState(command.entry.State, state) {
+				updateCommand(command, CommandAcked, nil)
+				return nil
+			}
+			err = errors.New("no confirmation from event stream")
+			updateCommand(command, CommandSent, err)
+		}
+	}
+
+	updateCommand(command, CommandFailed, err)
+	log.Printf(Red+"schalter command %s %s failed: %s\n"+Reset, command.entry.Item, command.entry.State, err)
+	return fmt.Errorf("%w: %s %s: %s", ErrSchalterCommandFailed, command.entry.Item, command.entry.State, err)
+}
+
+func currentItemState(item string, isMqtt bool) (string, error) {
+	//mqtt devices report into sys.Schalter, openHAB items are asked directly
+	if isMqtt {
+		status, err := GetSchalterStatus(item)
+		if err != nil {
+			return "", err
+		}
+		return status.State, nil
+	}
+	return ReadSchalterState(item)
+}
+
+func commandAckTimeout() time.Duration {
+	timeout, err := strconv.Atoi(os.Getenv("SCHALTER_ACK_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+func AckSchalterCommand(item string, state string) {
+	//called by the event stream for every item state it sees
+	pendingAcksMu.Lock()
+	defer pendingAcksMu.Unlock()
+
+	waiting := pendingAcks[item]
+	for i, command := range waiting {
+		if !commandMatchesState(command.entry.State, state) {
+			continue
+		}
+		pendingAcks[item] = append(waiting[:i:i], waiting[i+1:]...)
+		select {
+		case command.acked <- true:
+		default:
+		}
+		return
+	}
+}
+
+func commandMatchesState(command string, state string) bool {
+	//openHAB reports ON as 100 for dimmers and adds units to quantities
+	state = strings.TrimSpace(state)
+	if command == state {
+		return true
+	}
+	stateNumber, err := parseNumber(strings.TrimRight(state, " °CFK%"))
+	if err != nil {
+		return false
+	}
+	switch command {
+	case "ON":
+		return stateNumber > 0
+	case "OFF":
+		return stateNumber == 0
+	}
+	commandNumber, err := parseNumber(strings.TrimRight(command, " °CFK%"))
+	return err == nil && commandNumber == stateNumber
+}
+
+func addPendingAck(command *queuedCommand) {
+	pendingAcksMu.Lock()
+	defer pendingAcksMu.Unlock()
+	pendingAcks[command.entry.Item] = append(pendingAcks[command.entry.Item], command)
+}
+
+func removePendingAck(command *queuedCommand) {
+	pendingAcksMu.Lock()
+	defer pendingAcksMu.Unlock()
+
+	waiting := pendingAcks[command.entry.Item]
+	for i, c := range waiting {
+		if c == command {
+			pendingAcks[command.entry.Item] = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(pendingAcks[command.entry.Item]) == 0 {
+		delete(pendingAcks, command.entry.Item)
+	}
+	//drop an ack that raced with the timeout
+	select {
+	case <-command.acked:
+	default:
+	}
+}
+
+func updateCommand(command *queuedCommand, status string, err error) {
+	command.entry.Status = status
+	command.entry.Updated = time.Now()
+	command.entry.Error = ""
+	if err != nil {
+		command.entry.Error = err.Error()
+	}
+	recordCommand(command.entry, false)
+}
+
+func recordCommand(entry SchalterCommandEntry, insert bool) {
+	//keep recent commands in memory, the table keeps all of them
+	commandsMu.Lock()
+	found := false
+	for i := len(commandLog) - 1; i >= 0; i-- {
+		if commandLog[i].Id == entry.Id {
+			commandLog[i] = entry
+			found = true
+			break
+		}
+	}
+	if !found {
+		if len(commandLog) == commandLogSize {
+			commandLog = commandLog[1:]
+		}
+		commandLog = append(commandLog, entry)
+	}
+	commandsMu.Unlock()
+
+	db, err := DBConnection()
+	if err != nil {
+		log.Printf(Red+"error recording schalter command: %s\n"+Reset, err)
+		return
+	}
+	defer db.Close()
+
+	if insert {
+		_, err = db.Exec("INSERT INTO sys.SchalterCommands (id, item, state, status, attempts, error, created, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", entry.Id, entry.Item, entry.State, entry.Status, entry.Attempts, entry.Error, entry.Created.UnixMilli(), entry.Updated.UnixMilli())
+	} else {
+		_, err = db.Exec("UPDATE sys.SchalterCommands SET status = ?, attempts = ?, error = ?, updated = ? WHERE id = ?", entry.Status, entry.Attempts, entry.Error, entry.Updated.UnixMilli(), entry.Id)
+	}
+	if err != nil {
+		log.Printf(Red+"error recording schalter command: %s\n"+Reset, err)
+	}
+}
+
+func GetSchalterCommand(id int64) SchalterCommandEntry {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+
+	for i := len(commandLog) - 1; i >= 0; i-- {
+		if commandLog[i].Id == id {
+			return commandLog[i]
+		}
+	}
+	return SchalterCommandEntry{}
+}
+
+func GetSchalterCommands(item string) []SchalterCommandEntry {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+
+	commands := make([]SchalterCommandEntry, 0)
+	for i := len(commandLog) - 1; i >= 0; i-- {
+		if item == "" || commandLog[i].Item == item {
+			commands = append(commands, commandLog[i])
+		}
+	}
+	return commands
+}
+
+func SchalterCommands(w http.ResponseWriter, r *http.Request) {
+	//status of recent device commands, newest first
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		//check if session token is valid
+		session_token := r.URL.Query().Get("session_token")
+		if session_token == "" {
+			SendError(w, http.StatusUnauthorized, errors.New("no session token"))
+			return
+		}
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		if rawId := r.URL.Query().Get("id"); rawId != "" {
+			id, err := strconv.ParseInt(rawId, 10, 64)
+			if err != nil {
+				SendError(w, http.StatusBadRequest, fmt.Errorf("invalid id: %s", rawId))
+				return
+			}
+			command := GetSchalterCommand(id)
+			if command.Id == 0 {
+				SendError(w, http.StatusNotFound, errors.New("command not found"))
+				return
+			}
+			json.NewEncoder(w).Encode(command)
+			return
+		}
+		json.NewEncoder(w).Encode(GetSchalterCommands(r.URL.Query().Get("item")))
+	default:
+		log.Printf(Red + "Sorry, only GET method is supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET method is supported."})
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	. "github.com/GineHyte/server/models"
@@ -52,144 +55,229 @@ func SchalterControl(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		//the user owns the lock while the command runs
+		username, err := GetUsernameFromSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting user: %s", err))
+			return
+		}
+		owner := SchalterSource{Type: SourceUser, Id: username}
+
 		temp := t["command"].(map[string]interface{})
 		//convert SchalterCommand to SchalterStatus
 		SchalterStatusRes := SchalterStatus{}
+		var group, room, floor string
 		for key, value := range temp {
 			switch key {
 			case "name":
 				SchalterStatusRes.Name = value.(string)
 			case "state":
-				SchalterStatusRes.State = value.(string)
+				//typed devices may send numbers, e.g. a brightness of 40
+				switch state := value.(type) {
+				case string:
+					SchalterStatusRes.State = state
+				case float64:
+					SchalterStatusRes.State = strconv.FormatFloat(state, 'f', -1, 64)
+				}
 			case "locked":
 				SchalterStatusRes.Locked, _ = strconv.Atoi(value.(string))
 			case "widgetId":
 				SchalterStatusRes.WidgetId, _ = value.(string)
 			case "scriptState":
 				SchalterStatusRes.ScriptState, _ = value.(bool)
+			case "group":
+				group, _ = value.(string)
+			case "room":
+				room, _ = value.(string)
+			case "floor":
+				floor, _ = value.(string)
 			}
 		}
 
+		//fan out group target to all members
+		if group != "" || room != "" || floor != "" {
+			members, err := GetSchalterGroupMembers(group, room, floor)
+			if err != nil {
+				SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting group members: %s", err))
+				return
+			}
+			if len(members) == 0 {
+				SendError(w, http.StatusNotFound, errors.New("no schalter in target"))
+				return
+			}
+			results, err := SchalterGroupCommand(members, SchalterStatusRes.State, SchalterStatusRes.Locked, owner)
+			if err != nil {
+				SendError(w, http.StatusBadRequest, err)
+				return
+			}
+			json.NewEncoder(w).Encode(results)
+			return
+		}
+
 		//check if SchalterCommand is valid
 		if SchalterStatusRes == (SchalterStatus{}) {
 			SendError(w, http.StatusBadRequest, errors.New("no SchalterCommand"))
 			return
 		}
 
-		//sync with Schalter db
-		dbSchalterStatus, err := GetSchalterStatus(SchalterStatusRes.Name)
-		if err != nil {
-			SendError(w, http.StatusInternalServerError, fmt.Errorf("error syncing Schalter data: %s", err))
+		err = RunSchalterCommand(SchalterStatusRes, owner)
+		if errors.Is(err, ErrSchalterLocked) {
+			SendError(w, http.StatusForbidden, err)
 			return
 		}
-
-		if dbSchalterStatus.Locked > 0 {
-			SendError(w, http.StatusForbidden, errors.New("schalter is locked"))
+		if errors.Is(err, ErrSchalterValue) {
+			SendError(w, http.StatusBadRequest, err)
 			return
 		}
-
-		if dbSchalterStatus.State == SchalterStatusRes.State {
-			log.Printf(Red + "schalter is already \n" + dbSchalterStatus.State + Reset)
+		if errors.Is(err, ErrSchalterInterlock) {
+			SendError(w, http.StatusConflict, err)
 			return
 		}
-
-		if test {
-			fmt.Printf(Blue + "THIS IS TEST MODE" + Reset + "\n")
-		}
-
-		//update Schalter db
-		err = UpdateSchalterStatus(SchalterStatusRes)
-		if err != nil {
-			SendError(w, http.StatusInternalServerError, fmt.Errorf("error updating schalter status: %s", err))
+		if errors.Is(err, ErrSchalterAlreadySet) {
+			log.Printf(Red + "schalter is already \n" + SchalterStatusRes.State + Reset)
 			return
 		}
-
-		var SchalterRawData string
-		SchalterRawData, err = GetRawSchalterStatus()
 		if err != nil {
-			SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting raw schalter status: %s", err))
+			SendError(w, http.StatusInternalServerError, err)
 			return
 		}
-		var SchalterData []SchalterStatus
-		SchalterData, err = ParseSchalterStatus(SchalterRawData)
+		return
+	case "GET":
+		//get Schalter status, optionally filtered by room, floor or group
+		params := r.URL.Query()
+		status, err := GetSchalterGroupMembers(params.Get("group"), params.Get("room"), params.Get("floor"))
 		if err != nil {
-			SendError(w, http.StatusInternalServerError, fmt.Errorf("error parsing schalter status: %s", err))
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting Schalter status: %s", err))
 			return
 		}
+		json.NewEncoder(w).Encode(status)
+		return
+	default:
+		log.Printf(Red + "Sorry, only POST method is supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only POST method is supported."})
+	}
+}
 
-		var i = SchalterDataContains(SchalterData, SchalterStatusRes.WidgetId)
-		var timerDuration time.Duration
+var ErrSchalterLocked = errors.New("schalter is locked")
+var ErrSchalterAlreadySet = errors.New("schalter is already set")
 
-		if strings.Contains(SchalterStatusRes.Name, "Licht") {
-			//Query Schalter
-			err = SchalterControllFunc(SchalterStatusRes.Name, SchalterStatusRes.State)
-			if err != nil {
-				SendError(w, http.StatusInternalServerError, fmt.Errorf("error querying schalter: %s", err))
-				return
-			}
+func RunSchalterCommand(SchalterStatusRes SchalterStatus, owner SchalterSource) error {
+	return RunSchalterCommandNotify(SchalterStatusRes, owner, nil)
+}
+
+func RunSchalterCommandNotify(SchalterStatusRes SchalterStatus, owner SchalterSource, done func(completed bool)) error {
+	//done is called once the command finished or was superseded
+	//sync with Schalter db
+	dbSchalterStatus, err := GetSchalterStatus(SchalterStatusRes.Name)
+	if err != nil {
+		return fmt.Errorf("error syncing Schalter data: %s", err)
+	}
+
+	//a higher priority takes over, the same or a lower one has to wait
+	if dbSchalterStatus.LockOwner != nil && *dbSchalterStatus.LockOwner != owner && !CanPreempt(owner, *dbSchalterStatus.LockOwner) {
+		return ErrSchalterLocked
+	}
+
+	//validate the command for the device type
+	SchalterStatusRes.State, err = NormalizeSchalterCommand(dbSchalterStatus.Type, SchalterStatusRes.State)
+	if err != nil {
+		return err
+	}
+	if rule, blocked := frostBlocked(dbSchalterStatus.Name, SchalterStatusRes.State); blocked && owner.Type != SourceSafety {
+		return fmt.Errorf("%w: frost protection %s", ErrSchalterLocked, rule)
+	}
+
+	if dbSchalterStatus.State == SchalterStatusRes.State {
+		return ErrSchalterAlreadySet
+	}
+	if SchalterStatusRes.WidgetId == "" {
+		SchalterStatusRes.WidgetId = dbSchalterStatus.WidgetId
+	}
+
+	if test {
+		fmt.Printf(Blue + "THIS IS TEST MODE" + Reset + "\n")
+	}
+
+	//lock the Schalter while the motor runs, a requested lock time keeps it longer
+	leaseDuration := 60 * time.Second
+	if SchalterStatusRes.Locked > 0 {
+		leaseDuration = time.Duration(SchalterStatusRes.Locked) * time.Second
+	}
+	err = AcquireLease(dbSchalterStatus.Name, owner, leaseDuration)
+	if err != nil {
+		return err
+	}
+	release := func() {
+		if SchalterStatusRes.Locked > 0 {
 			return
 		}
-		if SchalterStatusRes.State == "ON" && i != -1 {
-			//Query Schalter
-			err = SchalterControllFunc(SchalterData[i].Name, "ON")
-			if err != nil {
-				SendError(w, http.StatusInternalServerError, fmt.Errorf("error querying schalter: %s", err))
-				return
-			}
-			err = SchalterControllFunc(SchalterData[i+1].Name, "ON")
-			if err != nil {
-				SendError(w, http.StatusInternalServerError, fmt.Errorf("error querying schalter: %s", err))
-				return
-			}
-			timerDuration = 45 * time.Second
-			log.Printf("schalter %s is now %s%s%s, lock: %s\n", SchalterStatusRes.Name, Green, SchalterStatusRes.State, Reset, strconv.Itoa(SchalterStatusRes.Locked))
+		err := ReleaseLease(dbSchalterStatus.Name, owner)
+		if err != nil {
+			log.Printf(Red+"error releasing lease: %s\n"+Reset, err)
 		}
-		if SchalterStatusRes.State == "OFF" && i != -1 {
-			//Query Schalter
-			err = SchalterControllFunc(SchalterData[i].Name, "OFF")
-			if err != nil {
-				SendError(w, http.StatusInternalServerError, fmt.Errorf("error querying qchalter: %s", err))
-				return
-			}
-			err = SchalterControllFunc(SchalterData[i+1].Name, "ON")
-			if err != nil {
-				SendError(w, http.StatusInternalServerError, fmt.Errorf("error querying qchalter: %s", err))
-				return
-			}
-			timerDuration = 55 * time.Second
-			log.Printf("schalter %s is now %s%s%s, lock: %s\n", SchalterStatusRes.Name, Green, SchalterStatusRes.State, Reset, strconv.Itoa(SchalterStatusRes.Locked))
+	}
+	//give the lock back if the command fails before the motor runs
+	defer func() {
+		if err != nil {
+			release()
 		}
+	}()
 
-		//wait for timer
-		time.AfterFunc(timerDuration, func() {
-			//Query Schalter
-			err = SchalterControllFunc(SchalterData[i].Name, "OFF")
-			if err != nil {
-				SendError(w, http.StatusInternalServerError, fmt.Errorf("error querying Schalter: %s", err))
-				return
-			}
-			err = SchalterControllFunc(SchalterData[i+1].Name, "OFF")
-			if err != nil {
-				SendError(w, http.StatusInternalServerError, fmt.Errorf("error querying Schalter: %s", err))
-				return
-			}
-		})
+	//everything but shutters is a single item that takes the command directly
+	if dbSchalterStatus.Type != TypeShutter {
+		defer release()
+		//Query Schalter
+		_, err = SendSchalterCommand(dbSchalterStatus.Name, SchalterStatusRes.State)
+		if err != nil {
+			return fmt.Errorf("error querying schalter: %s", err)
+		}
 
-		return
-	case "GET":
-		//get Schalter status
-		status, err := GetSchalterStatuses()
+		//update Schalter db once the device confirmed the command
+		err = UpdateSchalterStatus(SchalterStatusRes, owner)
 		if err != nil {
-			SendError(w, http.StatusInternalServerError, fmt.Errorf("error getting Schalter status: %s", err))
-			return
+			return fmt.Errorf("error updating schalter status: %s", err)
 		}
-		json.NewEncoder(w).Encode(status)
-		return
-	default:
-		log.Printf(Red + "Sorry, only POST method is supported.\n" + r.Method + Reset)
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only POST method is supported."})
+		if done != nil {
+			done(true)
+		}
+		return nil
 	}
+	//shutters need the direction and power item of their widget
+	var direction, power string
+	direction, power, err = GetSchalterMotorItems(SchalterStatusRes.WidgetId)
+	if err != nil {
+		return fmt.Errorf("error querying schalter: %s", err)
+	}
+
+	var timerDuration time.Duration
+	if SchalterStatusRes.State == "ON" {
+		timerDuration = 45 * time.Second
+	} else {
+		timerDuration = 55 * time.Second
+	}
+
+	//drive the motor through the interlock, the lock is released once it stopped
+	err = DriveMotor(direction, power, SchalterStatusRes.State, timerDuration, owner, func(completed bool) {
+		if completed {
+			release()
+		}
+		if done != nil {
+			done(completed)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	//update Schalter db
+	err = UpdateSchalterStatus(SchalterStatusRes, owner)
+	if err != nil {
+		return fmt.Errorf("error updating schalter status: %s", err)
+	}
+	log.Printf("schalter %s is now %s%s%s, lock: %s\n", SchalterStatusRes.Name, Green, SchalterStatusRes.State, Reset, strconv.Itoa(SchalterStatusRes.Locked))
+
+	return nil
 }
 
 func SchalterControllFunc(target string, state string) error {
@@ -209,25 +297,49 @@ func SchalterControllFunc(target string, state string) error {
 
 	//create http request
 	req, err := http.NewRequest("POST", httpposturl, bytes.NewBufferString(state))
-	req.Header.Set("Content-Type", "text/plain")
 	if err != nil {
 		return fmt.Errorf("schalter %s: %s", target, err)
 	}
+	req.Header.Set("Content-Type", "text/plain")
 
 	//send http request
-	client := &http.Client{}
+	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("schalter %s: %s", target, err)
 	}
 	defer resp.Body.Close()
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
+	//openHAB answers 200 or 202 when it accepted the command
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("schalter %s: %s %s", target, resp.Status, strings.TrimSpace(buf.String()))
+	}
 
 	return nil
 }
 
+func ReadSchalterState(target string) (string, error) {
+	//current state of an openHAB item
+	Schalter_IP := os.Getenv("schalter_IP")
+	httpgeturl := Schalter_IP + "rest/items/" + target + "/state"
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(httpgeturl)
+	if err != nil {
+		return "", fmt.Errorf("schalter %s: %s", target, err)
+	}
+	defer resp.Body.Close()
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("schalter %s: %s %s", target, resp.Status, strings.TrimSpace(buf.String()))
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
 func GetSchalterStatuses() ([]SchalterStatus, error) {
 	//db connection
 	db, err := tools.DBConnection()
@@ -238,7 +350,7 @@ func GetSchalterStatuses() ([]SchalterStatus, error) {
 
 	//get all schalter status
 	var Schalter_data *sql.Rows
-	Schalter_data, err = db.Query("SELECT name, state, widgetId, locked, scriptState, currentCommand FROM sys.Schalter")
+	Schalter_data, err = db.Query("SELECT s.name, s.state, s.widgetId, s.scriptState, s.currentCommand, COALESCE(r.room, ''), COALESCE(r.floor, ''), COALESCE(t.type, '') FROM sys.Schalter s LEFT JOIN sys.SchalterRooms r ON r.name = s.name LEFT JOIN sys.SchalterTypes t ON t.name = s.name")
 	if err != nil {
 		return []SchalterStatus{}, fmt.Errorf("getSchalterStatuses: %s", err)
 	}
@@ -249,16 +361,24 @@ func GetSchalterStatuses() ([]SchalterStatus, error) {
 		var name string
 		var state string
 		var widgetId string
-		var locked int
 		var scriptState bool
 		var currentCommand *string
+		var room string
+		var floor string
+		var schalterType string
 
-		err := Schalter_data.Scan(&name, &state, &widgetId, &locked, &scriptState, &currentCommand)
+		err := Schalter_data.Scan(&name, &state, &widgetId, &scriptState, &currentCommand, &room, &floor, &schalterType)
 		if err != nil {
 			return []SchalterStatus{}, fmt.Errorf("getSchalterStatuses: %s", err)
 		}
 
-		SchalterStatuses = append(SchalterStatuses, SchalterStatus{Name: name, State: state, WidgetId: widgetId, Locked: locked, ScriptState: scriptState, CurrentCommand: currentCommand})
+		SchalterStatusRes := SchalterStatus{Name: name, State: state, WidgetId: widgetId, ScriptState: scriptState, CurrentCommand: currentCommand, Room: room, Floor: floor, Type: schalterType}
+		if SchalterStatusRes.Type == "" {
+			SchalterStatusRes.Type = defaultSchalterType(name)
+		}
+		SchalterStatusRes.Value = ParseSchalterValue(SchalterStatusRes.Type, state)
+		applyLease(&SchalterStatusRes)
+		SchalterStatuses = append(SchalterStatuses, SchalterStatusRes)
 	}
 
 	return SchalterStatuses, nil
@@ -274,7 +394,13 @@ func SchalterDataContains(SchalterData []SchalterStatus, widgetId string) int {
 	return -1
 }
 
-func UpdateSchalterStatus(SchalterStatusRes SchalterStatus, widgetId ...string) error {
+func UpdateSchalterStatus(SchalterStatusRes SchalterStatus, source SchalterSource, widgetId ...string) error {
+	//previous state for the history
+	oldStatus, err := GetSchalterStatus(SchalterStatusRes.Name, widgetId...)
+	if err != nil {
+		return fmt.Errorf("updateSchalterStatus: %s", err)
+	}
+
 	//db connection
 	db, err := DBConnection()
 	if err != nil {
@@ -285,14 +411,19 @@ func UpdateSchalterStatus(SchalterStatusRes SchalterStatus, widgetId ...string)
 
 	//update Schalter db
 	if len(widgetId) > 0 {
-		_, err = db.Exec("UPDATE sys.Schalter SET state = ?, locked = ? WHERE widgetId = ?", SchalterStatusRes.State, SchalterStatusRes.Locked, widgetId[0])
+		_, err = db.Exec("UPDATE sys.Schalter SET state = ? WHERE widgetId = ?", SchalterStatusRes.State, widgetId[0])
 	} else {
-		_, err = db.Exec("UPDATE sys.Schalter SET state = ?, locked = ? WHERE name = ?", SchalterStatusRes.State, SchalterStatusRes.Locked, SchalterStatusRes.Name)
+		_, err = db.Exec("UPDATE sys.Schalter SET state = ? WHERE name = ?", SchalterStatusRes.State, SchalterStatusRes.Name)
 	}
 	if err != nil {
 		return fmt.Errorf("updateSchalterStatus: %s", err)
 	}
 
+	if oldStatus.State != SchalterStatusRes.State {
+		RecordSchalterHistory(oldStatus.Name, oldStatus.State, SchalterStatusRes.State, source)
+	}
+
+	PublishSchalterEvent(EventState, SchalterStatusRes.Name, widgetId...)
 	return nil
 }
 
@@ -307,9 +438,9 @@ func GetSchalterStatus(name string, widgetId ...string) (SchalterStatus, error)
 	var Schalter_data *sql.Rows
 	//read data from db and compare with Schalter data
 	if len(widgetId) > 0 {
-		Schalter_data, err = db.Query("SELECT name, state, widgetId, locked, scriptState, currentCommand FROM sys.Schalter WHERE widgetId = ?", widgetId[0])
+		Schalter_data, err = db.Query("SELECT s.name, s.state, s.widgetId, s.scriptState, s.currentCommand, COALESCE(r.room, ''), COALESCE(r.floor, ''), COALESCE(t.type, '') FROM sys.Schalter s LEFT JOIN sys.SchalterRooms r ON r.name = s.name LEFT JOIN sys.SchalterTypes t ON t.name = s.name WHERE s.widgetId = ?", widgetId[0])
 	} else {
-		Schalter_data, err = db.Query("SELECT name, state, widgetId, locked, scriptState, currentCommand FROM sys.Schalter WHERE name = ?", name)
+		Schalter_data, err = db.Query("SELECT s.name, s.state, s.widgetId, s.scriptState, s.currentCommand, COALESCE(r.room, ''), COALESCE(r.floor, ''), COALESCE(t.type, '') FROM sys.Schalter s LEFT JOIN sys.SchalterRooms r ON r.name = s.name LEFT JOIN sys.SchalterTypes t ON t.name = s.name WHERE s.name = ?", name)
 	}
 	if err != nil {
 		return SchalterStatus{}, fmt.Errorf("syncSchalterData: %s", err)
@@ -320,24 +451,31 @@ func GetSchalterStatus(name string, widgetId ...string) (SchalterStatus, error)
 		var name string
 		var state string
 		var widgetId string
-		var locked int
 		var scriptState bool
 		var currentCommand *string
+		var room string
+		var floor string
+		var schalterType string
 
-		err := Schalter_data.Scan(&name, &state, &widgetId, &locked, &scriptState, &currentCommand)
+		err := Schalter_data.Scan(&name, &state, &widgetId, &scriptState, &currentCommand, &room, &floor, &schalterType)
 		if err != nil {
 			return SchalterStatus{}, fmt.Errorf("syncSchalterData: %s", err)
 		}
-		SchalterStatusRes := SchalterStatus{Name: name, State: state, WidgetId: widgetId, Locked: locked, ScriptState: scriptState, CurrentCommand: currentCommand}
+		SchalterStatusRes := SchalterStatus{Name: name, State: state, WidgetId: widgetId, ScriptState: scriptState, CurrentCommand: currentCommand, Room: room, Floor: floor, Type: schalterType}
+		if SchalterStatusRes.Type == "" {
+			SchalterStatusRes.Type = defaultSchalterType(name)
+		}
+		SchalterStatusRes.Value = ParseSchalterValue(SchalterStatusRes.Type, state)
+		applyLease(&SchalterStatusRes)
 		return SchalterStatusRes, nil
 	}
 	return SchalterStatus{}, errors.New("syncSchalterData: no Schalter data found")
 }
 
-func GetRawSchalterStatus() (string, error) {
+func GetRawSchalterStatus(page SchalterPage) (string, error) {
 	//http url for influxdb
 	Schalter_IP := os.Getenv("schalter_IP")
-	httpposturl := Schalter_IP + "basicui/app?w=0300&sitemap=traumhaus"
+	httpposturl := Schalter_IP + "basicui/app?w=" + url.QueryEscape(page.Page) + "&sitemap=" + url.QueryEscape(page.Sitemap)
 
 	//create http request
 	req, err := http.NewRequest("GET", httpposturl, nil)
@@ -367,9 +505,9 @@ func ParseSchalterStatus(rawData string) ([]SchalterStatus, error) {
 	for _, line := range SchalterStatusLines {
 		if strings.Contains(line, "<input type=\"checkbox\"") {
 			if strings.Contains(line, "checked") {
-				SchalterStatusRes = append(SchalterStatusRes, SchalterStatus{strings.Split(strings.Split(line, "id=\"oh-checkbox-")[1], "\"")[0], "ON", widgetId, 0, false, nil})
+				SchalterStatusRes = append(SchalterStatusRes, SchalterStatus{Name: strings.Split(strings.Split(line, "id=\"oh-checkbox-")[1], "\"")[0], State: "ON", WidgetId: widgetId})
 			} else {
-				SchalterStatusRes = append(SchalterStatusRes, SchalterStatus{strings.Split(strings.Split(line, "id=\"oh-checkbox-")[1], "\"")[0], "OFF", widgetId, 0, false, nil})
+				SchalterStatusRes = append(SchalterStatusRes, SchalterStatus{Name: strings.Split(strings.Split(line, "id=\"oh-checkbox-")[1], "\"")[0], State: "OFF", WidgetId: widgetId})
 			}
 		}
 		if strings.Contains(line, "data-widget-id=") {
@@ -379,134 +517,132 @@ func ParseSchalterStatus(rawData string) ([]SchalterStatus, error) {
 	return SchalterStatusRes, nil
 }
 
-func SchalterEventStream() {
-	SCHALTER_IP := os.Getenv("SCHALTER_IP")
+// every page runs its own event stream, they share the recent direction events
+var widgetsIdEventBus []string
+var widgetsIdEventBusMu sync.Mutex
 
-	subscribeUrl := SCHALTER_IP + "rest/sitemaps/events/subscribe"
-	req, err := http.NewRequest("POST", subscribeUrl, nil)
-	if err != nil {
-		log.Printf(Red+"error creating request: %s\n"+Reset, err)
-		return
-	}
+func handleSchalterEvent(page SchalterPage, msg *sse.Event) {
+	rawData := string(msg.Data)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf(Red+"error sending request: %s\n"+Reset, err)
+	if strings.Contains(rawData, "ALIVE") {
 		return
 	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-	var t map[string]interface{}
-	err = decoder.Decode(&t)
 
+	//parse Schalter status
+	var t1 map[string]interface{}
+	err := json.Unmarshal([]byte(rawData), &t1)
 	if err != nil {
 		log.Printf(Red+"error decoding response: %s\n"+Reset, err)
 		return
 	}
 
-	urlToken := t["context"].(map[string]interface{})["headers"].(map[string]interface{})["Location"].([]interface{})[0].(string)
-	streamUrl := urlToken + "?sitemap=traumhaus&pageid=0300"
-	clientStream := sse.NewClient(streamUrl)
+	//malformed events are skipped instead of taking the stream down
+	item, ok := t1["item"].(map[string]interface{})
+	if !ok {
+		log.Printf(Red+"error decoding event: no item in %s\n"+Reset, rawData)
+		return
+	}
+	name, nameOk := item["name"].(string)
+	state, stateOk := item["state"].(string)
+	widgetId, widgetOk := t1["widgetId"].(string)
+	if !nameOk || !stateOk || !widgetOk {
+		log.Printf(Red+"error decoding event: missing name, state or widgetId in %s\n"+Reset, rawData)
+		return
+	}
 
-	var widgetsIdEventBus []string
+	//confirm queued commands for this item
+	AckSchalterCommand(name, state)
 
-	//subscribe to Schalter event
-	clientStream.Subscribe("event", func(msg *sse.Event) {
-		rawData := string(msg.Data)
+	if strings.Contains(name, "Richtung") {
+		widgetsIdEventBusMu.Lock()
+		if len(widgetsIdEventBus) > 10 {
+			widgetsIdEventBus = widgetsIdEventBus[:len(widgetsIdEventBus)-1]
+		}
+		widgetsIdEventBus = append(widgetsIdEventBus, widgetId) //TODO: continue here
+		widgetsIdEventBusMu.Unlock()
+		return
+	}
 
-		if strings.Contains(rawData, "ALIVE") {
+	//single item devices are stored under their item name
+	if itemStatus, err := GetSchalterStatus(name); err == nil && itemStatus.Type != TypeShutter {
+		//the owner of a running command stores the state itself
+		hardware := SchalterSource{Type: SourceHardware, Id: name}
+		if itemStatus.LockOwner != nil && *itemStatus.LockOwner != hardware {
 			return
 		}
-
-		//parse Schalter status
-		var t1 map[string]interface{}
-		err = json.Unmarshal([]byte(rawData), &t1)
+		err = UpdateSchalterStatus(SchalterStatus{Name: name, State: state}, hardware)
 		if err != nil {
-			log.Printf(Red+"error decoding response: %s\n"+Reset, err)
+			log.Printf(Red+"error updating schalter status: %s\n"+Reset, err)
 			return
 		}
-
-		name := t1["item"].(map[string]interface{})["name"].(string)
-		state := t1["item"].(map[string]interface{})["state"].(string)
-		widgetId := t1["widgetId"].(string)
-
-		if strings.Contains(name, "Richtung") {
-			if len(widgetsIdEventBus) > 10 {
-				widgetsIdEventBus = widgetsIdEventBus[:len(widgetsIdEventBus)-1]
-			}
-			widgetsIdEventBus = append(widgetsIdEventBus, widgetId) //TODO: continue here
-			return
+		if state == "ON" {
+			log.Printf("schalterCommand name: " + name + Green + " state: " + state + Reset + "\n")
 		}
-
-		if strings.Contains(name, "Licht") {
-			err = UpdateSchalterStatus(SchalterStatus{Name: name, State: state, Locked: 0})
-			if err != nil {
-				log.Printf(Red+"error updating schalter status: %s\n"+Reset, err)
-				return
-			}
-			if state == "ON" {
-				log.Printf("schalterCommand name: " + name + Green + " state: " + state + Reset + "\n")
-			}
-			if state == "OFF" {
-				log.Printf("schalterCommand name: " + name + Red + " state: " + state + Reset + "\n")
-			}
-			return
+		if state == "OFF" {
+			log.Printf("schalterCommand name: " + name + Red + " state: " + state + Reset + "\n")
 		}
+		return
+	}
 
-		//convert widgetId to int
-		widgetIdInt, err := strconv.Atoi(widgetId)
-		if err != nil {
-			log.Printf(Red+"error converting widgetId to int: %s\n"+Reset, err)
-			return
-		}
-		widgetId = "0" + strconv.Itoa(widgetIdInt-1)
+	//convert widgetId to int
+	widgetIdInt, err := strconv.Atoi(widgetId)
+	if err != nil {
+		log.Printf(Red+"error converting widgetId to int: %s\n"+Reset, err)
+		return
+	}
+	widgetId = "0" + strconv.Itoa(widgetIdInt-1)
 
-		// get Schalter status from html
-		rawSchalterStatus, err := GetRawSchalterStatus()
-		if err != nil {
-			log.Printf(Red+"error getting raw schalter status: %s\n"+Reset, err)
-			return
-		}
+	// get Schalter status from html of the page the event came from
+	rawSchalterStatus, err := GetRawSchalterStatus(page)
+	if err != nil {
+		log.Printf(Red+"error getting raw schalter status: %s\n"+Reset, err)
+		return
+	}
 
-		SchalterStatuses, err := ParseSchalterStatus(rawSchalterStatus)
-		if err != nil {
-			log.Printf(Red+"error parsing schalter status: %s\n"+Reset, err)
-			return
-		}
+	SchalterStatuses, err := ParseSchalterStatus(rawSchalterStatus)
+	if err != nil {
+		log.Printf(Red+"error parsing schalter status: %s\n"+Reset, err)
+		return
+	}
 
-		//chrck if schater on or off
-		SchalterStatusIndex := SchalterDataContains(SchalterStatuses, widgetId)
-		if SchalterStatusIndex == -1 {
-			log.Printf(Red+"error getting schalter status: %s\n"+Reset, err)
-			return
-		}
-		richtungState := SchalterStatuses[SchalterStatusIndex].State
+	//chrck if schater on or off
+	SchalterStatusIndex := SchalterDataContains(SchalterStatuses, widgetId)
+	if SchalterStatusIndex == -1 {
+		log.Printf(Red+"error getting schalter status: %s\n"+Reset, err)
+		return
+	}
+	richtungState := SchalterStatuses[SchalterStatusIndex].State
 
-		dbSchalterStatus, err := GetSchalterStatus(name, widgetId)
-		if err != nil {
-			log.Printf(Red+"error syncing schalter data: %s\n"+Reset, err)
-			return
-		}
+	dbSchalterStatus, err := GetSchalterStatus(name, widgetId)
+	if err != nil {
+		log.Printf(Red+"error syncing schalter data: %s\n"+Reset, err)
+		return
+	}
 
-		if dbSchalterStatus.Locked > 0 {
-			return
-		}
+	//events of our own commands arrive while a user or script holds the lease
+	hardware := SchalterSource{Type: SourceHardware, Id: widgetId}
+	if dbSchalterStatus.LockOwner != nil && *dbSchalterStatus.LockOwner != hardware {
+		return
+	}
 
-		//update Schalter status
-		if state == "ON" {
-			if richtungState == "ON" {
-				err = UpdateSchalterStatus(SchalterStatus{Name: name, State: richtungState, Locked: 50}, widgetId)
-				log.Printf("schalterCommand name: " + name + Green + " state: " + richtungState + Reset + "\n")
-			} else {
-				err = UpdateSchalterStatus(SchalterStatus{Name: name, State: richtungState, Locked: 60}, widgetId)
-				log.Printf("schalterCommand name: " + name + Red + " state: " + richtungState + Reset + "\n")
+	//update Schalter status
+	if state == "ON" {
+		if richtungState == "ON" {
+			err = AcquireLease(dbSchalterStatus.Name, hardware, 50*time.Second)
+			if err == nil {
+				err = UpdateSchalterStatus(SchalterStatus{Name: name, State: richtungState}, hardware, widgetId)
 			}
+			log.Printf("schalterCommand name: " + name + Green + " state: " + richtungState + Reset + "\n")
+		} else {
+			err = AcquireLease(dbSchalterStatus.Name, hardware, 60*time.Second)
+			if err == nil {
+				err = UpdateSchalterStatus(SchalterStatus{Name: name, State: richtungState}, hardware, widgetId)
+			}
+			log.Printf("schalterCommand name: " + name + Red + " state: " + richtungState + Reset + "\n")
 		}
-		if err != nil {
-			log.Printf(Red+"error updating schalter status: %s\n"+Reset, err)
-			return
-		}
-	})
+	}
+	if err != nil {
+		log.Printf(Red+"error updating schalter status: %s\n"+Reset, err)
+		return
+	}
 }
@@ -0,0 +1,222 @@
+package schalter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+// discovered pages are cached, sitemaps change rarely
+var sitemapCacheTTL = 10 * time.Minute
+
+var sitemapPages = make(map[string][]string)
+var sitemapWidgets = make(map[string][]SitemapWidget)
+var sitemapLoaded = make(map[string]time.Time)
+var sitemapMu sync.Mutex
+
+func sitemapConfig() map[string][]string {
+	//SCHALTER_SITEMAPS="traumhaus:0300,0400;garten", a sitemap without pages is discovered
+	config := make(map[string][]string)
+	raw := os.Getenv("SCHALTER_SITEMAPS")
+	if raw == "" {
+		config["traumhaus"] = []string{"0300"}
+		return config
+	}
+	for _, entry := range strings.Split(raw, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		sitemap, pages, _ := strings.Cut(entry, ":")
+		sitemap = strings.TrimSpace(sitemap)
+		config[sitemap] = make([]string, 0)
+		for _, page := range strings.Split(pages, ",") {
+			if page = strings.TrimSpace(page); page != "" {
+				config[sitemap] = append(config[sitemap], page)
+			}
+		}
+	}
+	return config
+}
+
+func GetSchalterPages() ([]SchalterPage, error) {
+	//all configured pages, discovered pages for sitemaps without a page list
+	config := sitemapConfig()
+	sitemaps := make([]string, 0, len(config))
+	for sitemap := range config {
+		sitemaps = append(sitemaps, sitemap)
+	}
+	sort.Strings(sitemaps)
+
+	pages := make([]SchalterPage, 0)
+	for _, sitemap := range sitemaps {
+		configured := config[sitemap]
+		if len(configured) == 0 {
+			discovered, _, err := DiscoverSitemap(sitemap)
+			if err != nil {
+				return []SchalterPage{}, fmt.Errorf("getSchalterPages: %s", err)
+			}
+			configured = discovered
+		}
+		for _, page := range configured {
+			pages = append(pages, SchalterPage{Sitemap: sitemap, Page: page})
+		}
+	}
+	return pages, nil
+}
+
+func DiscoverSitemap(sitemap string) ([]string, []SitemapWidget, error) {
+	//all page ids and widgets of a sitemap from the openHAB REST api
+	sitemapMu.Lock()
+	if loaded, ok := sitemapLoaded[sitemap]; ok && time.Since(loaded) < sitemapCacheTTL {
+		pages, widgets := sitemapPages[sitemap], sitemapWidgets[sitemap]
+		sitemapMu.Unlock()
+		return pages, widgets, nil
+	}
+	sitemapMu.Unlock()
+
+	SCHALTER_IP := os.Getenv("SCHALTER_IP")
+	httpgeturl := SCHALTER_IP + "rest/sitemaps/" + url.PathEscape(sitemap) + "?type=json"
+
+	req, err := http.NewRequest("GET", httpgeturl, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discoverSitemap %s: %s", sitemap, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discoverSitemap %s: %s", sitemap, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, fmt.Errorf("discoverSitemap %s: %s", sitemap, resp.Status)
+	}
+
+	var t map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&t)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discoverSitemap %s: %s", sitemap, err)
+	}
+	homepage, ok := t["homepage"].(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("discoverSitemap %s: no homepage", sitemap)
+	}
+
+	pages := make([]string, 0)
+	widgets := make([]SitemapWidget, 0)
+	walkSitemapPage(sitemap, homepage, &pages, &widgets)
+
+	sitemapMu.Lock()
+	sitemapPages[sitemap] = pages
+	sitemapWidgets[sitemap] = widgets
+	sitemapLoaded[sitemap] = time.Now()
+	sitemapMu.Unlock()
+
+	return pages, widgets, nil
+}
+
+func walkSitemapPage(sitemap string, page map[string]interface{}, pages *[]string, widgets *[]SitemapWidget) {
+	pageId, _ := page["id"].(string)
+	for _, p := range *pages {
+		if p == pageId {
+			return
+		}
+	}
+	*pages = append(*pages, pageId)
+
+	rawWidgets, _ := page["widgets"].([]interface{})
+	walkSitemapWidgets(sitemap, pageId, rawWidgets, pages, widgets)
+}
+
+func walkSitemapWidgets(sitemap string, pageId string, rawWidgets []interface{}, pages *[]string, widgets *[]SitemapWidget) {
+	for _, rawWidget := range rawWidgets {
+		widget, ok := rawWidget.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		sitemapWidget := SitemapWidget{Sitemap: sitemap, Page: pageId}
+		sitemapWidget.WidgetId, _ = widget["widgetId"].(string)
+		sitemapWidget.Type, _ = widget["type"].(string)
+		sitemapWidget.Label, _ = widget["label"].(string)
+		if item, ok := widget["item"].(map[string]interface{}); ok {
+			sitemapWidget.Item, _ = item["name"].(string)
+			sitemapWidget.ItemType, _ = item["type"].(string)
+			sitemapWidget.State, _ = item["state"].(string)
+		}
+		if sitemapWidget.Item != "" {
+			*widgets = append(*widgets, sitemapWidget)
+		}
+
+		//frames nest widgets on the same page, linked pages open a new one
+		if children, ok := widget["widgets"].([]interface{}); ok {
+			walkSitemapWidgets(sitemap, pageId, children, pages, widgets)
+		}
+		if linkedPage, ok := widget["linkedPage"].(map[string]interface{}); ok {
+			walkSitemapPage(sitemap, linkedPage, pages, widgets)
+		}
+	}
+}
+
+func GetSchalterMotorItems(widgetId string) (string, string, error) {
+	//direction and power item of a shutter widget, the power item follows the
+	//direction item on the same page
+	pages, err := GetSchalterPages()
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, page := range pages {
+		rawData, err := GetRawSchalterStatus(page)
+		if err != nil {
+			return "", "", err
+		}
+		pageData, err := ParseSchalterStatus(rawData)
+		if err != nil {
+			return "", "", err
+		}
+		i := SchalterDataContains(pageData, widgetId)
+		if i == -1 {
+			continue
+		}
+		if i+1 >= len(pageData) {
+			return "", "", fmt.Errorf("widget %s has no power item on page %s", widgetId, page.Page)
+		}
+		return pageData[i].Name, pageData[i+1].Name, nil
+	}
+	return "", "", fmt.Errorf("widget %s not found", widgetId)
+}
+
+func SchalterSitemaps(w http.ResponseWriter, r *http.Request) {
+	//pages and widgets of every configured sitemap
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		result := make(map[string]interface{})
+		for sitemap := range sitemapConfig() {
+			pages, widgets, err := DiscoverSitemap(sitemap)
+			if err != nil {
+				SendError(w, http.StatusBadGateway, fmt.Errorf("error discovering sitemap: %s", err))
+				return
+			}
+			result[sitemap] = map[string]interface{}{"pages": pages, "widgets": widgets}
+		}
+		json.NewEncoder(w).Encode(result)
+	default:
+		log.Printf(Red + "Sorry, only GET method is supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET method is supported."})
+	}
+}
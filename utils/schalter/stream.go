@@ -0,0 +1,299 @@
+package schalter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/GineHyte/server/models"
+
+	"github.com/r3labs/sse/v2"
+	"gopkg.in/cenkalti/backoff.v1"
+)
+
+// health of the event stream of every page, by sitemap/page
+var streamHealth = make(map[string]*SchalterStreamHealth)
+var streamHealthMu sync.Mutex
+
+// openHAB sends ALIVE events, a stream without any event for this long is dead
+var streamIdleTimeout = 2 * time.Minute
+
+func SchalterEventStream() {
+	//one event stream per page, openHAB only reports the widgets of the subscribed page
+	retry := backoff.NewExponentialBackOff()
+	retry.InitialInterval = 1 * time.Second
+	retry.MaxInterval = 1 * time.Minute
+	retry.MaxElapsedTime = 0
+
+	var pages []SchalterPage
+	for {
+		var err error
+		pages, err = GetSchalterPages()
+		if err == nil {
+			break
+		}
+		log.Printf(Red+"schalter event stream: %s\n"+Reset, err)
+		time.Sleep(retry.NextBackOff())
+	}
+
+	for _, page := range pages {
+		go superviseSchalterEventStream(page)
+	}
+}
+
+func superviseSchalterEventStream(page SchalterPage) {
+	//keep the openHAB event stream of page connected for the lifetime of the server
+	retry := backoff.NewExponentialBackOff()
+	retry.InitialInterval = 1 * time.Second
+	retry.MaxInterval = 1 * time.Minute
+	retry.MaxElapsedTime = 0
+
+	for {
+		connected := time.Now()
+		err := runSchalterEventStream(page)
+		if err == nil {
+			err = errors.New("event stream closed")
+		}
+		setStreamDisconnected(page, err)
+		log.Printf(Red+"schalter event stream %s/%s: %s\n"+Reset, page.Sitemap, page.Page, err)
+
+		//a stream that stayed up for a while starts over with a short delay
+		if time.Since(connected) > streamIdleTimeout {
+			retry.Reset()
+		}
+		time.Sleep(retry.NextBackOff())
+	}
+}
+
+func runSchalterEventStream(page SchalterPage) error {
+	SCHALTER_IP := os.Getenv("SCHALTER_IP")
+
+	//every connection needs a fresh subscription
+	subscribeUrl := SCHALTER_IP + "rest/sitemaps/events/subscribe"
+	req, err := http.NewRequest("POST", subscribeUrl, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %s", err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error subscribing: %s", resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	var t map[string]interface{}
+	err = decoder.Decode(&t)
+	if err != nil {
+		return fmt.Errorf("error decoding response: %s", err)
+	}
+
+	urlToken, err := subscriptionLocation(t)
+	if err != nil {
+		return err
+	}
+	streamUrl := urlToken + "?sitemap=" + url.QueryEscape(page.Sitemap) + "&pageid=" + url.QueryEscape(page.Page)
+	clientStream := sse.NewClient(streamUrl)
+	clientStream.ReconnectStrategy = &backoff.StopBackOff{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//resynchronise the state that changed while we were not listening
+	setStreamConnected(page)
+	err = SyncSchalterStatuses(page)
+	if err != nil {
+		log.Printf(Red+"error resyncing schalter status: %s\n"+Reset, err)
+	}
+
+	//watchdog, drop the connection if openHAB stops sending
+	go func() {
+		ticker := time.NewTicker(streamIdleTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if streamIdle(page) {
+					log.Printf(Red+"schalter event stream %s/%s idle, reconnecting\n"+Reset, page.Sitemap, page.Page)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	//subscribe to Schalter event
+	return clientStream.SubscribeWithContext(ctx, "event", func(msg *sse.Event) {
+		markStreamEvent(page)
+		handleSchalterEvent(page, msg)
+	})
+}
+
+func subscriptionLocation(t map[string]interface{}) (string, error) {
+	//context.headers.Location[0] of the subscribe response
+	subscription, _ := t["context"].(map[string]interface{})
+	headers, _ := subscription["headers"].(map[string]interface{})
+	location, _ := headers["Location"].([]interface{})
+	if len(location) == 0 {
+		return "", errors.New("error subscribing: no location in response")
+	}
+	urlToken, ok := location[0].(string)
+	if !ok || urlToken == "" {
+		return "", errors.New("error subscribing: no location in response")
+	}
+	return urlToken, nil
+}
+
+func SyncSchalterStatuses(page SchalterPage) error {
+	//write the state shown by openHAB on page into the Schalter db
+	rawSchalterStatus, err := GetRawSchalterStatus(page)
+	if err != nil {
+		return fmt.Errorf("syncSchalterStatuses: %s", err)
+	}
+	SchalterData, err := ParseSchalterStatus(rawSchalterStatus)
+	if err != nil {
+		return fmt.Errorf("syncSchalterStatuses: %s", err)
+	}
+	dbStatuses, err := GetSchalterStatuses()
+	if err != nil {
+		return fmt.Errorf("syncSchalterStatuses: %s", err)
+	}
+
+	for _, dbStatus := range dbStatuses {
+		for _, status := range SchalterData {
+			//single item devices are stored by item name, shutters by their direction widget
+			if dbStatus.Type != TypeShutter {
+				if status.Name != dbStatus.Name {
+					continue
+				}
+			} else if status.WidgetId != dbStatus.WidgetId {
+				continue
+			}
+			if status.State != dbStatus.State {
+				err = UpdateSchalterStatus(SchalterStatus{Name: dbStatus.Name, State: status.State}, SchalterSource{Type: SourceHardware, Id: "sync"})
+				if err != nil {
+					return fmt.Errorf("syncSchalterStatuses: %s", err)
+				}
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+func SchalterHealth(w http.ResponseWriter, r *http.Request) {
+	//report the connection status of the openHAB event stream of every page
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		health := GetStreamHealth()
+		if !StreamConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	default:
+		log.Printf(Red + "Sorry, only GET method is supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only GET method is supported."})
+	}
+}
+
+func GetStreamHealth() []SchalterStreamHealth {
+	streamHealthMu.Lock()
+	defer streamHealthMu.Unlock()
+
+	health := make([]SchalterStreamHealth, 0, len(streamHealth))
+	for _, pageHealth := range streamHealth {
+		health = append(health, *pageHealth)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		if health[i].Sitemap != health[j].Sitemap {
+			return health[i].Sitemap < health[j].Sitemap
+		}
+		return health[i].Page < health[j].Page
+	})
+	return health
+}
+
+func StreamConnected() bool {
+	//true if the event streams of all pages are connected
+	streamHealthMu.Lock()
+	defer streamHealthMu.Unlock()
+
+	if len(streamHealth) == 0 {
+		return false
+	}
+	for _, pageHealth := range streamHealth {
+		if !pageHealth.Connected {
+			return false
+		}
+	}
+	return true
+}
+
+func pageStreamHealth(page SchalterPage) *SchalterStreamHealth {
+	//callers hold streamHealthMu
+	key := page.Sitemap + "/" + page.Page
+	if streamHealth[key] == nil {
+		streamHealth[key] = &SchalterStreamHealth{Sitemap: page.Sitemap, Page: page.Page}
+	}
+	return streamHealth[key]
+}
+
+func setStreamConnected(page SchalterPage) {
+	streamHealthMu.Lock()
+	defer streamHealthMu.Unlock()
+
+	now := time.Now()
+	health := pageStreamHealth(page)
+	health.Connected = true
+	health.Since = &now
+	health.LastEvent = &now
+	health.LastError = ""
+}
+
+func setStreamDisconnected(page SchalterPage, err error) {
+	streamHealthMu.Lock()
+	defer streamHealthMu.Unlock()
+
+	now := time.Now()
+	health := pageStreamHealth(page)
+	if health.Connected {
+		health.Reconnects++
+	}
+	health.Connected = false
+	health.Since = &now
+	health.LastError = err.Error()
+}
+
+func markStreamEvent(page SchalterPage) {
+	streamHealthMu.Lock()
+	defer streamHealthMu.Unlock()
+
+	now := time.Now()
+	pageStreamHealth(page).LastEvent = &now
+}
+
+func streamIdle(page SchalterPage) bool {
+	streamHealthMu.Lock()
+	defer streamHealthMu.Unlock()
+
+	health := pageStreamHealth(page)
+	return health.LastEvent == nil || time.Since(*health.LastEvent) > streamIdleTimeout
+}
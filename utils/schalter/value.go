@@ -0,0 +1,267 @@
+package schalter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/GineHyte/server/models"
+	. "github.com/GineHyte/server/utils/tools"
+)
+
+var ErrSchalterValue = errors.New("invalid schalter value")
+
+func defaultSchalterType(name string) string {
+	//devices without a configured type keep the old name based behaviour
+	if strings.Contains(name, "Licht") {
+		return TypeSwitch
+	}
+	return TypeShutter
+}
+
+func NormalizeSchalterCommand(deviceType string, raw string) (string, error) {
+	//validate a command for deviceType and convert it to the openHAB command
+	command := strings.TrimSpace(raw)
+	upper := strings.ToUpper(command)
+	if upper == "ON" || upper == "OFF" {
+		if deviceType == TypeColorTemp || deviceType == TypeSetpoint {
+			return "", fmt.Errorf("%w: %s does not support %s", ErrSchalterValue, deviceType, upper)
+		}
+		return upper, nil
+	}
+
+	switch deviceType {
+	case TypeDimmer:
+		percent, err := parsePercent(command)
+		if err != nil {
+			return "", err
+		}
+		return formatNumber(percent), nil
+	case TypeColorTemp:
+		if strings.HasSuffix(upper, "K") {
+			kelvin, err := parseNumber(strings.TrimSuffix(upper, "K"))
+			if err != nil {
+				return "", err
+			}
+			if kelvin < 1000 || kelvin > 10000 {
+				return "", fmt.Errorf("%w: color temperature %s out of range", ErrSchalterValue, command)
+			}
+			return formatNumber(kelvin) + " K", nil
+		}
+		percent, err := parsePercent(command)
+		if err != nil {
+			return "", err
+		}
+		return formatNumber(percent), nil
+	case TypeColor:
+		if !strings.Contains(command, ",") {
+			//a single value sets the brightness only
+			percent, err := parsePercent(command)
+			if err != nil {
+				return "", err
+			}
+			return formatNumber(percent), nil
+		}
+		hue, saturation, brightness, err := parseHSB(command)
+		if err != nil {
+			return "", err
+		}
+		return formatNumber(hue) + "," + formatNumber(saturation) + "," + formatNumber(brightness), nil
+	case TypeSetpoint:
+		number, err := parseNumber(strings.TrimSuffix(strings.TrimSuffix(command, "C"), "°"))
+		if err != nil {
+			return "", err
+		}
+		return formatNumber(number), nil
+	}
+
+	return "", fmt.Errorf("%w: %s only supports ON and OFF", ErrSchalterValue, deviceType)
+}
+
+func ParseSchalterValue(deviceType string, state string) *SchalterValue {
+	//typed view of a stored state, nil for plain ON/OFF devices
+	state = strings.TrimSpace(state)
+	switch deviceType {
+	case TypeDimmer:
+		if percent, err := parsePercent(onOffPercent(state)); err == nil {
+			return &SchalterValue{Percent: &percent}
+		}
+	case TypeColorTemp:
+		if strings.HasSuffix(state, "K") {
+			if kelvin, err := parseNumber(strings.TrimSuffix(state, "K")); err == nil {
+				return &SchalterValue{Kelvin: &kelvin}
+			}
+		} else if percent, err := parsePercent(state); err == nil {
+			return &SchalterValue{Percent: &percent}
+		}
+	case TypeColor:
+		if hue, saturation, brightness, err := parseHSB(state); err == nil {
+			return &SchalterValue{Hue: &hue, Saturation: &saturation, Brightness: &brightness}
+		}
+		if brightness, err := parsePercent(onOffPercent(state)); err == nil {
+			return &SchalterValue{Brightness: &brightness}
+		}
+	case TypeSetpoint:
+		//openHAB sends quantity types like "21.5 °C"
+		if number, err := parseNumber(strings.TrimRight(state, " °CFK")); err == nil {
+			return &SchalterValue{Number: &number}
+		}
+	}
+	return nil
+}
+
+func onOffPercent(state string) string {
+	switch state {
+	case "ON":
+		return "100"
+	case "OFF":
+		return "0"
+	}
+	return state
+}
+
+func parseNumber(raw string) (float64, error) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, fmt.Errorf("%w: %s is not a number", ErrSchalterValue, raw)
+	}
+	return number, nil
+}
+
+func parsePercent(raw string) (float64, error) {
+	percent, err := parseNumber(strings.TrimSuffix(strings.TrimSpace(raw), "%"))
+	if err != nil {
+		return 0, err
+	}
+	if percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("%w: %s is not between 0 and 100%%", ErrSchalterValue, raw)
+	}
+	return percent, nil
+}
+
+func parseHSB(raw string) (float64, float64, float64, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("%w: %s is not hue,saturation,brightness", ErrSchalterValue, raw)
+	}
+	hue, err := parseNumber(parts[0])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if hue < 0 || hue > 360 {
+		return 0, 0, 0, fmt.Errorf("%w: hue %s is not between 0 and 360", ErrSchalterValue, parts[0])
+	}
+	saturation, err := parsePercent(parts[1])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	brightness, err := parsePercent(parts[2])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return hue, saturation, brightness, nil
+}
+
+func formatNumber(number float64) string {
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
+
+func CreateSchalterTypeTable() error {
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("createSchalterTypeTable: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.SchalterTypes (name VARCHAR(255) NOT NULL PRIMARY KEY, type VARCHAR(32) NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("createSchalterTypeTable: %s", err)
+	}
+
+	return nil
+}
+
+func SetSchalterType(name string, deviceType string) error {
+	switch deviceType {
+	case TypeSwitch, TypeShutter, TypeDimmer, TypeColorTemp, TypeColor, TypeSetpoint:
+	default:
+		return fmt.Errorf("%w: unknown type %s", ErrSchalterValue, deviceType)
+	}
+
+	//db connection
+	db, err := DBConnection()
+	if err != nil {
+		return fmt.Errorf("setSchalterType: %s", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO sys.SchalterTypes (name, type) VALUES (?, ?) ON DUPLICATE KEY UPDATE type = VALUES(type)", name, deviceType)
+	if err != nil {
+		return fmt.Errorf("setSchalterType: %s", err)
+	}
+
+	return nil
+}
+
+func SchalterTypes(w http.ResponseWriter, r *http.Request) {
+	//set the device type of a Schalter with session token
+	switch r.Method {
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := CheckSession(session_token)
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		//check if name is valid
+		name, _ := t["name"].(string)
+		if name == "" {
+			SendError(w, http.StatusBadRequest, errors.New("no name"))
+			return
+		}
+		deviceType, _ := t["type"].(string)
+
+		err = SetSchalterType(name, deviceType)
+		if errors.Is(err, ErrSchalterValue) {
+			SendError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			SendError(w, http.StatusInternalServerError, fmt.Errorf("error setting schalter type: %s", err))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	default:
+		log.Printf(Red + "Sorry, only POST method is supported.\n" + r.Method + Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Sorry, only POST method is supported."})
+	}
+}
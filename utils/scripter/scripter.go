@@ -219,6 +219,7 @@ func ExecuteCommand(command string, widgetId string, session_token string) error
 	if err != nil {
 		return fmt.Errorf("error setting command: %s", err)
 	}
+	schalter.PublishSchalterEvent(schalter.EventScript, "", widgetId)
 
 	//get scriptState
 	scriptState, err := GetScriptState(widgetId)
@@ -244,6 +245,12 @@ func ExecuteCommand(command string, widgetId string, session_token string) error
 			wg = sync.WaitGroup{}
 			return fmt.Errorf("error executing command: %s", err)
 		}
+	case "SET":
+		err = setValue(command, widgetId)
+		if err != nil {
+			wg = sync.WaitGroup{}
+			return fmt.Errorf("error executing command: %s", err)
+		}
 	case "WHILE":
 		condition := strings.Split(command, " ")[1:4]
 		statements := strings.Split(strings.Join(strings.Split(command, " ")[4:], " "), ";")
@@ -261,98 +268,81 @@ func ExecuteCommand(command string, widgetId string, session_token string) error
 }
 
 func onOff(command string, commandType string, widgetId string) error {
-	SchalterStatusRes := models.SchalterStatus{}
-	SchalterStatusRes.Name = ""
-	SchalterStatusRes.State = commandType
-	SchalterStatusRes.WidgetId = widgetId
-	if commandType == "ON" {
-		SchalterStatusRes.Locked = 45
-	} else {
-		SchalterStatusRes.Locked = 55
-	}
-
 	//sync with Schalter db
-	dbSchalterStatus, err := schalter.GetSchalterStatus("", SchalterStatusRes.WidgetId)
+	dbSchalterStatus, err := schalter.GetSchalterStatus("", widgetId)
 	if err != nil {
 		return fmt.Errorf("error syncing Schalter data: %s", err)
 	}
 
-	if dbSchalterStatus.Locked > 0 {
-		return errors.New("schalter is locked")
-	}
+	SchalterStatusRes := models.SchalterStatus{Name: dbSchalterStatus.Name, State: commandType, WidgetId: widgetId}
+	owner := models.SchalterSource{Type: models.SourceScript, Id: widgetId}
 
-	if dbSchalterStatus.State == SchalterStatusRes.State {
+	resumed, err := runScriptCommand(SchalterStatusRes, owner, widgetId)
+	if errors.Is(err, schalter.ErrSchalterAlreadySet) && !resumed {
 		return errors.New("schalter is already" + SchalterStatusRes.State)
 	}
-
-	//update Schalter db
-	err = schalter.UpdateSchalterStatus(SchalterStatusRes)
-	if err != nil {
-		return fmt.Errorf("error updating schalter status: %s", err)
+	if err != nil && !errors.Is(err, schalter.ErrSchalterAlreadySet) {
+		return fmt.Errorf("error running schalter command: %s", err)
 	}
+	return nil
+}
 
-	var SchalterRawData string
-	SchalterRawData, err = schalter.GetRawSchalterStatus()
-	if err != nil {
-		return fmt.Errorf("error getting raw schalter status: %s", err)
-	}
-	var SchalterData []models.SchalterStatus
-	SchalterData, err = schalter.ParseSchalterStatus(SchalterRawData)
-	if err != nil {
-		return fmt.Errorf("error parsing schalter status: %s", err)
+func setValue(command string, widgetId string) error {
+	//SET <name> <value>, e.g. SET Licht_Wohnzimmer 40%
+	parts := strings.Fields(command)
+	if len(parts) < 3 {
+		return fmt.Errorf("error parsing command: %s", command)
 	}
 
-	var i = schalter.SchalterDataContains(SchalterData, SchalterStatusRes.WidgetId)
-	var timerDuration time.Duration
+	SchalterStatusRes := models.SchalterStatus{Name: parts[1], State: strings.Join(parts[2:], " ")}
+	owner := models.SchalterSource{Type: models.SourceScript, Id: widgetId}
 
-	if strings.Contains(SchalterStatusRes.Name, "Licht") {
-		//Query Schalter
-		err = schalter.SchalterControllFunc(SchalterStatusRes.Name, SchalterStatusRes.State)
-		if err != nil {
-			return fmt.Errorf("error querying schalter: %s", err)
-		}
-		return nil
+	_, err := runScriptCommand(SchalterStatusRes, owner, widgetId)
+	if err != nil && !errors.Is(err, schalter.ErrSchalterAlreadySet) {
+		return fmt.Errorf("error running schalter command: %s", err)
 	}
-	if SchalterStatusRes.State == "ON" && i != -1 {
-		//Query Schalter
-		err = schalter.SchalterControllFunc(SchalterData[i].Name, "ON")
-		if err != nil {
-			return fmt.Errorf("error querying schalter: %s", err)
-		}
-		err = schalter.SchalterControllFunc(SchalterData[i+1].Name, "ON")
-		if err != nil {
-			return fmt.Errorf("error querying schalter: %s", err)
+	return nil
+}
+
+func runScriptCommand(SchalterStatusRes models.SchalterStatus, owner models.SchalterSource, widgetId string) (bool, error) {
+	//run a command and wait until it finished, a script that lost the Schalter
+	//to a higher priority pauses and repeats the command once it is free again
+	stopped := func() bool {
+		scriptState, err := GetScriptState(widgetId)
+		return err != nil || scriptState == "0"
+	}
+
+	resumed := false
+	for {
+		done := make(chan bool, 1)
+		err := schalter.RunSchalterCommandNotify(SchalterStatusRes, owner, func(completed bool) {
+			done <- completed
+		})
+		if errors.Is(err, schalter.ErrSchalterLocked) && schalter.Preempted(SchalterStatusRes.Name, owner) {
+			log.Printf("schalter %s: script %s paused\n", SchalterStatusRes.Name, widgetId)
+			if !schalter.WaitForControl(SchalterStatusRes.Name, owner, stopped) {
+				return resumed, nil
+			}
+			resumed = true
+			continue
 		}
-		timerDuration = 45 * time.Second
-		log.Printf("schalter %s is now %s%s%s, lock: %s\n", SchalterStatusRes.Name, models.Green, SchalterStatusRes.State, models.Reset, strconv.Itoa(SchalterStatusRes.Locked))
-	}
-	if SchalterStatusRes.State == "OFF" && i != -1 {
-		//Query Schalter
-		err = schalter.SchalterControllFunc(SchalterData[i].Name, "OFF")
 		if err != nil {
-			return fmt.Errorf("error querying qchalter: %s", err)
+			return resumed, err
 		}
-		err = schalter.SchalterControllFunc(SchalterData[i+1].Name, "ON")
-		if err != nil {
-			return fmt.Errorf("error querying qchalter: %s", err)
+		if <-done {
+			return resumed, nil
 		}
-		timerDuration = 55 * time.Second
-		log.Printf("schalter %s is now %s%s%s, lock: %s\n", SchalterStatusRes.Name, models.Green, SchalterStatusRes.State, models.Reset, strconv.Itoa(SchalterStatusRes.Locked))
-	}
 
-	//wait for timer
-	time.Sleep(timerDuration)
-
-	//Query Schalter
-	err = schalter.SchalterControllFunc(SchalterData[i].Name, "OFF")
-	if err != nil {
-		return fmt.Errorf("error querying schalter: %s", err)
-	}
-	err = schalter.SchalterControllFunc(SchalterData[i+1].Name, "OFF")
-	if err != nil {
-		return fmt.Errorf("error querying schalter: %s", err)
+		if !schalter.Preempted(SchalterStatusRes.Name, owner) {
+			log.Printf("schalter %s: script command %s was superseded\n", SchalterStatusRes.Name, SchalterStatusRes.State)
+			return resumed, nil
+		}
+		log.Printf("schalter %s: script %s paused\n", SchalterStatusRes.Name, widgetId)
+		if !schalter.WaitForControl(SchalterStatusRes.Name, owner, stopped) {
+			return resumed, nil
+		}
+		resumed = true
 	}
-	return nil
 }
 
 func whileLoop(condition []string, statements []string, widgetId string, session_token string) error {
@@ -525,24 +515,14 @@ func WhileCommandExecuter(statements []string, widgetId string, session_token st
 }
 
 func GetLastValue(name string, session_token string) (float64, error) {
-	//get current time
-	currentTime := time.Now()
-	//get time + 1 minute
-	nextMinute := currentTime.Add(-time.Hour*2 - time.Minute*5)
-	//format time
-	nextMinuteFormated := nextMinute.Format("2006-01-02T15:04:05.000Z")
-	currentTimeFormated := currentTime.Format("2006-01-02T15:04:05.000Z")
-
-	//pack the data from the query in a struct
-	queryStr := fmt.Sprintf("from(bucket: \"lcn\")\n"+
-		"|> range(start: %s, stop: %s)\n"+
-		"|> filter(fn: (r) => r[\"_measurement\"] == \"lcn\")\n"+
-		"|> filter(fn: (r) => r[\"name\"] == \"%s\")", nextMinuteFormated, currentTimeFormated, name)
-
-	queraRes, err := query.QueryInfluxDB(session_token, queryStr)
+	//last value of a series in the last two hours
+	queraRes, err := query.QuerySeries(session_token, models.SeriesQuery{Series: []string{name}, Start: "-2h5m", Fn: models.SeriesLast})
 	if err != nil {
 		return 0.0, fmt.Errorf("error querying influxdb: %s", err)
 	}
+	if len(queraRes.LineSets) == 0 || len(queraRes.LineSets[0]) == 0 {
+		return 0.0, fmt.Errorf("no value for %s", name)
+	}
 	//get last value
 	return queraRes.LineSets[0][len(queraRes.LineSets[0])-1].Value, nil
 }
@@ -649,6 +629,7 @@ func SetScriptState(widgetId string, scriptState string) error {
 	if err != nil {
 		return fmt.Errorf("error setting scriptState: %s", err)
 	}
+	schalter.PublishSchalterEvent(schalter.EventScript, "", widgetId)
 
 	return nil
 }
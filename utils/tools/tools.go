@@ -9,14 +9,11 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strconv"
-	"time"
+	"strings"
 
 	models "github.com/GineHyte/server/models"
 )
 
-var test = false
-
 func CheckSession(session_token string) (bool, error) {
 	log.Printf("CheckSession: %s\n", session_token)
 	//check if session token is valid
@@ -57,46 +54,35 @@ func RandomHex(n int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-func SchalterDbTimer() {
+func GetUsernameFromSession(session_token string) (string, error) {
+	//get username of the account behind a session token
 	//db connection
 	db, err := DBConnection()
 	if err != nil {
-		return
+		return "", fmt.Errorf("GetUsernameFromSession: %s", err)
 	}
 	defer db.Close()
 
-	for {
-		time.Sleep(1 * time.Second)
-		//get Schalter status
-		Schalter_status, err := db.Query("SELECT name, state, locked FROM sys.Schalter")
-		if err != nil {
-			return
-		}
-		defer Schalter_status.Close()
-
-		for Schalter_status.Next() {
-			var name string
-			var state string
-			var locked int
-			err := Schalter_status.Scan(&name, &state, &locked)
-			if err != nil {
-				log.Printf(models.Red+"error updating Schalter status: %s\n"+models.Reset, err)
-				return
-			}
+	var username string
+	err = db.QueryRow("SELECT a.username FROM sys.accounts a JOIN sys.sessions s ON s.influxToken = a.influxToken WHERE s.sessionToken = ?", session_token).Scan(&username)
+	if err != nil {
+		return "", fmt.Errorf("GetUsernameFromSession: %s", err)
+	}
+	return username, nil
+}
 
-			if locked > 0 {
-				if test {
-					log.Printf(models.Blue + "schalterDbTimer: " + name + " " + strconv.Itoa(locked) + models.Reset + "\n")
-				}
-				locked--
-				_, err = db.Exec("UPDATE sys.Schalter SET locked = ? WHERE name = ?", locked, name)
-				if err != nil {
-					log.Printf(models.Red+"error updating Schalter status: %s\n"+models.Reset, err)
-					return
-				}
-			}
+func IsAdmin(session_token string) (bool, error) {
+	//admins are the usernames listed in ADMIN_USERS, separated by commas
+	username, err := GetUsernameFromSession(session_token)
+	if err != nil {
+		return false, fmt.Errorf("IsAdmin: %s", err)
+	}
+	for _, admin := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if strings.TrimSpace(admin) == username {
+			return true, nil
 		}
 	}
+	return false, nil
 }
 
 func First[T, U any](val T, _ U) T {
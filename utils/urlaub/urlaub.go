@@ -0,0 +1,382 @@
+package urlaub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	models "github.com/GineHyte/server/models"
+	schalter "github.com/GineHyte/server/utils/schalter"
+	tools "github.com/GineHyte/server/utils/tools"
+)
+
+var ErrUrlaubUntil = errors.New("return date is in the past")
+
+var owner = models.SchalterSource{Type: models.SourceSchedule, Id: "urlaub"}
+
+// lights and shutters are replayed, MQTT devices like pumps and sockets never are
+var replayTypes = map[string]bool{
+	models.TypeSwitch:    true,
+	models.TypeDimmer:    true,
+	models.TypeColorTemp: true,
+	models.TypeShutter:   true,
+}
+
+var status = models.UrlaubStatus{Weeks: 2, Jitter: 20, Planned: make([]models.UrlaubAction, 0)}
+var plannedDay time.Time
+var lastCheck time.Time
+var mu sync.Mutex
+
+func CreateUrlaubTable() error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("createUrlaubTable: %s", err)
+	}
+	defer db.Close()
+
+	//a single row holds the vacation mode
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sys.Urlaub (id INT NOT NULL PRIMARY KEY, armed BOOL NOT NULL, since BIGINT, until BIGINT, weeks INT NOT NULL, jitter INT NOT NULL, reason VARCHAR(255) NOT NULL DEFAULT '')")
+	if err != nil {
+		return fmt.Errorf("createUrlaubTable: %s", err)
+	}
+
+	return nil
+}
+
+func LoadUrlaub() error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("loadUrlaub: %s", err)
+	}
+	defer db.Close()
+
+	var since, until *int64
+	var loaded models.UrlaubStatus
+	err = db.QueryRow("SELECT armed, since, until, weeks, jitter, reason FROM sys.Urlaub WHERE id = 1").Scan(&loaded.Armed, &since, &until, &loaded.Weeks, &loaded.Jitter, &loaded.Reason)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loadUrlaub: %s", err)
+	}
+	if since != nil {
+		t := time.UnixMilli(*since)
+		loaded.Since = &t
+	}
+	if until != nil {
+		t := time.UnixMilli(*until)
+		loaded.Until = &t
+	}
+	loaded.Planned = make([]models.UrlaubAction, 0)
+
+	mu.Lock()
+	status = loaded
+	lastCheck = time.Now()
+	mu.Unlock()
+
+	return nil
+}
+
+func saveUrlaub(saved models.UrlaubStatus) error {
+	//db connection
+	db, err := tools.DBConnection()
+	if err != nil {
+		return fmt.Errorf("saveUrlaub: %s", err)
+	}
+	defer db.Close()
+
+	var since, until *int64
+	if saved.Since != nil {
+		ms := saved.Since.UnixMilli()
+		since = &ms
+	}
+	if saved.Until != nil {
+		ms := saved.Until.UnixMilli()
+		until = &ms
+	}
+
+	_, err = db.Exec("INSERT INTO sys.Urlaub (id, armed, since, until, weeks, jitter, reason) VALUES (1, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE armed = VALUES(armed), since = VALUES(since), until = VALUES(until), weeks = VALUES(weeks), jitter = VALUES(jitter), reason = VALUES(reason)", saved.Armed, since, until, saved.Weeks, saved.Jitter, saved.Reason)
+	if err != nil {
+		return fmt.Errorf("saveUrlaub: %s", err)
+	}
+
+	return nil
+}
+
+func Arm(until *time.Time, weeks int, jitter int) error {
+	//replay the last weeks until we are back
+	if weeks <= 0 {
+		weeks = 2
+	}
+	if jitter < 0 {
+		jitter = 0
+	}
+	if until != nil && until.Before(time.Now()) {
+		return ErrUrlaubUntil
+	}
+
+	mu.Lock()
+	now := time.Now()
+	status = models.UrlaubStatus{Armed: true, Since: &now, Until: until, Weeks: weeks, Jitter: jitter, Planned: make([]models.UrlaubAction, 0)}
+	plannedDay = time.Time{}
+	lastCheck = now
+	saved := status
+	mu.Unlock()
+
+	log.Printf(models.Green+"vacation mode armed, replaying the last %d weeks\n"+models.Reset, weeks)
+	return saveUrlaub(saved)
+}
+
+func Disarm(reason string) error {
+	mu.Lock()
+	if !status.Armed {
+		mu.Unlock()
+		return nil
+	}
+	status.Armed = false
+	status.Reason = reason
+	status.Planned = make([]models.UrlaubAction, 0)
+	saved := status
+	mu.Unlock()
+
+	log.Printf(models.Yellow+"vacation mode disarmed: %s\n"+models.Reset, reason)
+	return saveUrlaub(saved)
+}
+
+func GetUrlaub() models.UrlaubStatus {
+	mu.Lock()
+	defer mu.Unlock()
+
+	current := status
+	current.Planned = make([]models.UrlaubAction, len(status.Planned))
+	copy(current.Planned, status.Planned)
+	return current
+}
+
+func UrlaubJob() {
+	//replay planned actions and stop once somebody is home again
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		mu.Lock()
+		armed := status.Armed
+		until := status.Until
+		mu.Unlock()
+		if !armed {
+			continue
+		}
+
+		if until != nil && time.Now().After(*until) {
+			err := Disarm("return date reached")
+			if err != nil {
+				log.Printf(models.Red+"error disarming vacation mode: %s\n"+models.Reset, err)
+			}
+			continue
+		}
+
+		present, err := checkPresence()
+		if err != nil {
+			log.Printf(models.Red+"error checking presence: %s\n"+models.Reset, err)
+		}
+		if present != "" {
+			err := Disarm(present)
+			if err != nil {
+				log.Printf(models.Red+"error disarming vacation mode: %s\n"+models.Reset, err)
+			}
+			continue
+		}
+
+		err = planDay(time.Now())
+		if err != nil {
+			log.Printf(models.Red+"error planning vacation day: %s\n"+models.Reset, err)
+		}
+		runDueActions()
+	}
+}
+
+func checkPresence() (string, error) {
+	//somebody switching by hand or in the app means we are back
+	mu.Lock()
+	from := lastCheck
+	mu.Unlock()
+	to := time.Now()
+
+	history, err := schalter.GetSchalterHistory("", from, to)
+	if err != nil {
+		return "", err
+	}
+
+	mu.Lock()
+	lastCheck = to
+	mu.Unlock()
+
+	for _, entry := range history {
+		switch {
+		case entry.Source.Type == models.SourceUser:
+			return "schalter " + entry.Name + " switched by " + entry.Source.Id, nil
+		case entry.Source.Type == models.SourceHardware && entry.Source.Id != "sync":
+			return "schalter " + entry.Name + " switched on the device", nil
+		}
+	}
+	return "", nil
+}
+
+func planDay(now time.Time) error {
+	//replay a random day of the last weeks with the same weekday
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	mu.Lock()
+	if plannedDay.Equal(today) {
+		mu.Unlock()
+		return nil
+	}
+	weeks := status.Weeks
+	jitter := time.Duration(status.Jitter) * time.Minute
+	mu.Unlock()
+
+	replayDay := today.AddDate(0, 0, -7*(rand.Intn(weeks)+1))
+	history, err := schalter.GetSchalterHistory("", replayDay, replayDay.AddDate(0, 0, 1))
+	if err != nil {
+		return fmt.Errorf("planDay: %s", err)
+	}
+	statuses, err := schalter.GetSchalterStatuses()
+	if err != nil {
+		return fmt.Errorf("planDay: %s", err)
+	}
+	mqttDevices, err := schalter.GetMqttDeviceNames()
+	if err != nil {
+		return fmt.Errorf("planDay: %s", err)
+	}
+	types := make(map[string]string)
+	for _, s := range statuses {
+		types[s.Name] = s.Type
+	}
+
+	planned := make([]models.UrlaubAction, 0)
+	for _, entry := range history {
+		//only lights and shutters, replays of earlier vacations are no presence
+		deviceType, ok := types[entry.Name]
+		if !ok || !replayTypes[deviceType] || mqttDevices[entry.Name] || entry.Source.Type == models.SourceSchedule {
+			continue
+		}
+
+		offset := entry.Time.Sub(replayDay)
+		if jitter > 0 {
+			offset += time.Duration(rand.Int63n(int64(2*jitter))) - jitter
+		}
+		planned = append(planned, models.UrlaubAction{Name: entry.Name, State: entry.NewState, Time: today.Add(offset), ReplayOf: entry.Time, Done: today.Add(offset).Before(now)})
+	}
+
+	mu.Lock()
+	status.Planned = planned
+	plannedDay = today
+	mu.Unlock()
+
+	log.Printf("vacation mode: replaying %d actions of %s\n", len(planned), replayDay.Format("2006-01-02"))
+	return nil
+}
+
+func runDueActions() {
+	mu.Lock()
+	now := time.Now()
+	due := make([]models.UrlaubAction, 0)
+	for i, action := range status.Planned {
+		if !action.Done && !action.Time.After(now) {
+			status.Planned[i].Done = true
+			due = append(due, action)
+		}
+	}
+	mu.Unlock()
+
+	for _, action := range due {
+		go func(action models.UrlaubAction) {
+			err := schalter.RunSchalterCommand(models.SchalterStatus{Name: action.Name, State: action.State}, owner)
+			if err != nil && !errors.Is(err, schalter.ErrSchalterAlreadySet) {
+				log.Printf(models.Red+"error replaying %s %s: %s\n"+models.Reset, action.Name, action.State, err)
+			}
+		}(action)
+	}
+}
+
+func Urlaub(w http.ResponseWriter, r *http.Request) {
+	//arm and disarm the vacation mode with session token
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(GetUrlaub())
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+		var t map[string]interface{}
+		err := decoder.Decode(&t)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error decoding json: %s", err))
+			return
+		}
+
+		//parse session token
+		session_token, _ := t["session_token"].(string)
+		if session_token == "" {
+			tools.SendError(w, http.StatusBadRequest, errors.New("no session token"))
+			return
+		}
+
+		//check if session token is valid
+		is_valid, err := tools.CheckSession(session_token)
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error checking session: %s", err))
+			return
+		}
+		if !is_valid {
+			tools.SendError(w, http.StatusForbidden, errors.New("session token is invalid"))
+			return
+		}
+
+		armed, ok := t["armed"].(bool)
+		if !ok {
+			tools.SendError(w, http.StatusBadRequest, errors.New("no armed"))
+			return
+		}
+
+		if !armed {
+			err = Disarm("disarmed by user")
+		} else {
+			var until *time.Time
+			if rawUntil, _ := t["until"].(string); rawUntil != "" {
+				parsed, err := time.Parse(time.RFC3339, rawUntil)
+				if err != nil {
+					tools.SendError(w, http.StatusBadRequest, fmt.Errorf("invalid until: %s", rawUntil))
+					return
+				}
+				until = &parsed
+			}
+			weeks, _ := t["weeks"].(float64)
+			jitter, ok := t["jitter"].(float64)
+			if !ok {
+				jitter = 20
+			}
+			err = Arm(until, int(weeks), int(jitter))
+		}
+		if errors.Is(err, ErrUrlaubUntil) {
+			tools.SendError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			tools.SendError(w, http.StatusInternalServerError, fmt.Errorf("error setting vacation mode: %s", err))
+			return
+		}
+
+		json.NewEncoder(w).Encode(GetUrlaub())
+	default:
+		log.Printf(models.Red + "Sorry, only GET and POST methods are supported.\n" + r.Method + models.Reset)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(models.ErrorResponse{Error: "Sorry, only GET and POST methods are supported."})
+	}
+}